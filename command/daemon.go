@@ -1,22 +1,47 @@
 package command
 
 import (
-	"crypto/tls"
 	"flag"
 	"fmt"
+	"github.com/mefellows/mirror/filesystem/fs"
 	"github.com/mefellows/mirror/filesystem/remote"
 	"github.com/mefellows/mirror/pki"
 	"log"
 	"net"
-	"net/rpc"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 )
 
 type DaemonCommand struct {
-	Meta     Meta
-	Port     int    // Which port to listen on
-	Host     string // Which network host/ip to listen on
-	Insecure bool   // Enable/Disable TLS
+	Meta            Meta
+	Port            int    // Which port to listen on
+	Host            string // Which network host/ip to listen on
+	Insecure        bool   // Enable/Disable TLS
+	Root            string // The directory clients are confined to, if any
+	Exports         ExportSlice
+	ACL             string // The file listing what each client may do, if any
+	Config          string // The configuration file, in place of the options above
+	CheckConfig     bool
+	ShutdownTimeout time.Duration // How long to wait for calls in progress on shutdown
+}
+
+// Exports given as NAME=PATH[,MODE[,SUBJECT...]]
+type ExportSlice []*remote.Export
+
+func (e *ExportSlice) String() string {
+	return fmt.Sprintf("%v", *e)
+}
+
+func (e *ExportSlice) Set(value string) error {
+	export, err := remote.ParseExport(value)
+	if err != nil {
+		return err
+	}
+	*e = append(*e, export)
+	return nil
 }
 
 func (c *DaemonCommand) Run(args []string) int {
@@ -26,55 +51,239 @@ func (c *DaemonCommand) Run(args []string) int {
 	cmdFlags.IntVar(&c.Port, "port", 8123, "The http port to listen on")
 	cmdFlags.StringVar(&c.Host, "host", "", "The host/ip to bind to. Defaults to 0.0.0.0")
 	cmdFlags.BoolVar(&c.Insecure, "insecure", false, "Disable TLS connection")
+	cmdFlags.StringVar(&c.Root, "root", "", "Confine clients to this directory")
+	cmdFlags.Var(&c.Exports, "export", "A directory clients reach by name, as NAME=PATH[,MODE[,SUBJECT...]]")
+	cmdFlags.StringVar(&c.ACL, "acl", "", "A file listing what each client may do")
+	cmdFlags.StringVar(&c.Config, "config", "", "The configuration file of the daemon")
+	cmdFlags.BoolVar(&c.CheckConfig, "check-config", false, "Check the configuration file, and exit")
+	cmdFlags.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", remote.DefaultShutdownTimeout, "How long to wait for calls in progress on shutdown")
 
 	// Validate
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
 
-	c.Meta.Ui.Output(fmt.Sprintf("Running mirror daemon on port %d", c.Port))
-	remoteFs := new(remote.RemoteFileSystem)
-	rpc.Register(remoteFs)
+	if c.Config != "" {
+		var conflicts []string
+		cmdFlags.Visit(func(f *flag.Flag) {
+			if f.Name != "config" && f.Name != "check-config" {
+				conflicts = append(conflicts, "--"+f.Name)
+			}
+		})
+		if len(conflicts) > 0 {
+			c.Meta.Ui.Error(fmt.Sprintf("--config can not be used with %s. Set them in %s instead", strings.Join(conflicts, ", "), c.Config))
+			return 1
+		}
+	} else if c.CheckConfig {
+		c.Meta.Ui.Error("--check-config requires --config")
+		return 1
+	}
 
-	service := fmt.Sprintf("%s:%d", c.Host, c.Port)
-	pkiMgr, err := pki.New()
+	daemon, err := c.load()
 	if err != nil {
-		c.Meta.Ui.Error(fmt.Sprintf("Unable to setup public key infrastructure: %s", err.Error()))
+		c.Meta.Ui.Error(err.Error())
 		return 1
 	}
-	pkiMgr.Config.Insecure = c.Insecure
+	if c.CheckConfig {
+		c.Meta.Ui.Output(fmt.Sprintf("%s is valid", c.Config))
+		c.describe(daemon)
+		return 0
+	}
+
+	logFile, err := openLog(daemon.LogFile)
 	if err != nil {
-		c.Meta.Ui.Error(fmt.Sprintf("Unable to setup PKI infrastructure for daemon: %s", err.Error()))
-		log.Fatalf("server: listen: %s", err)
+		c.Meta.Ui.Error(fmt.Sprintf("Unable to open log file: %s", err.Error()))
+		return 1
+	}
+	if err = loadCertificates(daemon); err != nil {
+		c.Meta.Ui.Error(err.Error())
+		return 1
 	}
 
-	var listener net.Listener
-	config, err := pkiMgr.GetServerTLSConfig()
+	var listeners []net.Listener
+	for _, address := range daemon.Listen {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			log.Fatalf("server: listen: %s", err)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	c.Meta.Ui.Output(fmt.Sprintf("Running mirror daemon on %s", strings.Join(daemon.Listen, ", ")))
+	c.describe(daemon)
+
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			errs <- daemon.Serve(listener)
+		}(listener)
+	}
+
+	// Serve only returns once accepting clients has failed for good
+	status := 0
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGHUP, os.Interrupt)
+	for {
+		select {
+		case err := <-errs:
+			if err != remote.ErrDaemonClosed {
+				log.Printf("server: accept: %s, shutting down", err)
+				status = 1
+			}
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				logFile = c.reload(daemon, logFile)
+				continue
+			}
+			log.Printf("server: %s, waiting for calls in progress to finish", sig)
+		}
+		break
+	}
+
+	signal.Stop(signals)
+	if err := daemon.Shutdown(); err != nil {
+		log.Printf("server: shutdown: %s", err)
+		status = 1
+	}
+	log.Println("server: stopped")
+	if logFile != nil {
+		logFile.Close()
+	}
+	return status
+}
+
+// The Daemon given by the configuration file, or the command line options
+func (c *DaemonCommand) load() (*remote.Daemon, error) {
+	if c.Config == "" {
+		return c.flagDaemon()
+	}
+	config, err := remote.LoadDaemonConfig(c.Config)
 	if err != nil {
-		log.Fatalf("server: listen: %s", err)
+		return nil, err
+	}
+	return config.Daemon()
+}
+
+// Reads the configuration and certificates again, for the clients that
+// connect from now on. If they are invalid, the daemon carries on as it was.
+func (c *DaemonCommand) reload(daemon *remote.Daemon, logFile *os.File) *os.File {
+	log.Println("server: SIGHUP received, reloading")
+	next, err := c.load()
+	if err == nil {
+		err = loadCertificates(next)
 	}
-	listener, err = tls.Listen("tcp", service, config)
 	if err != nil {
-		log.Fatalf("server: listen: %s", err)
+		log.Printf("server: reload failed, keeping the current configuration: %s", err)
+		return logFile
 	}
-	for {
-		conn, err := listener.Accept()
-		defer conn.Close()
+	if strings.Join(next.Listen, ",") != strings.Join(daemon.Listen, ",") {
+		log.Printf("server: the daemon must be restarted to listen on %s", strings.Join(next.Listen, ", "))
+	}
+
+	// Reopened even if unchanged, for log rotation
+	nextLog, err := openLog(next.LogFile)
+	if err != nil {
+		log.Printf("server: reload failed, unable to open log file: %s", err)
+		return logFile
+	}
+	if logFile != nil {
+		logFile.Close()
+	}
+	daemon.Reload(next)
+	log.Println("server: reloaded")
+	return nextLog
+}
+
+// Logs to path from now on, or to stderr if there is none
+func openLog(path string) (*os.File, error) {
+	if path == "" {
+		log.SetOutput(os.Stderr)
+		return nil, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	log.SetOutput(file)
+	return file, nil
+}
+
+// Sets up the default certificates of the pki command, for a Daemon that
+// has none configured
+func loadCertificates(daemon *remote.Daemon) error {
+	if daemon.TLS != nil {
+		return nil
+	}
+	pkiMgr, err := pki.New()
+	if err != nil {
+		return fmt.Errorf("Unable to setup public key infrastructure: %s", err.Error())
+	}
+	pkiMgr.Config.Insecure = daemon.Insecure
+	if daemon.TLS, err = pkiMgr.GetServerTLSConfig(); err != nil {
+		return fmt.Errorf("Unable to load the certificates of the daemon: %s", err.Error())
+	}
+	return nil
+}
+
+// The Daemon given by the command line options
+func (c *DaemonCommand) flagDaemon() (*remote.Daemon, error) {
+	daemon := &remote.Daemon{
+		Listen:          []string{fmt.Sprintf("%s:%d", c.Host, c.Port)},
+		Insecure:        c.Insecure,
+		ShutdownTimeout: c.ShutdownTimeout,
+	}
+	remoteFs := &daemon.FileSystem
+	if c.Root != "" {
+		root, err := fs.RootPath(c.Root)
 		if err != nil {
-			log.Printf("server: accept: %s", err)
-			break
+			return nil, fmt.Errorf("Invalid --root: %v", err)
 		}
-		log.Printf("server: accepted from %s", conn.RemoteAddr())
-		go handleClient(conn)
+		remoteFs.Root = root
 	}
 
-	return 0
+	if len(c.Exports) > 0 {
+		if c.Root != "" {
+			return nil, fmt.Errorf("--root can not be used with --export")
+		}
+		remoteFs.Exports = make(remote.Exports)
+		for _, export := range c.Exports {
+			if _, ok := remoteFs.Exports[export.Name]; ok {
+				return nil, fmt.Errorf("Export '%s' is defined more than once", export.Name)
+			}
+			if other := remoteFs.Exports.Overlapping(export); other != nil {
+				return nil, fmt.Errorf("Export '%s' (%s) overlaps export '%s' (%s), and exports can not be nested", export.Name, export.Path, other.Name, other.Path)
+			}
+			remoteFs.Exports[export.Name] = export
+		}
+	}
+
+	if c.ACL != "" {
+		acl, err := remote.LoadACL(c.ACL)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid --acl: %v", err)
+		}
+		remoteFs.ACL = acl
+	}
+	return daemon, nil
 }
 
-func handleClient(conn net.Conn) {
-	defer conn.Close()
-	rpc.ServeConn(conn)
-	log.Println("server: conn: closed")
+func (c *DaemonCommand) describe(daemon *remote.Daemon) {
+	remoteFs := daemon.FileSystem
+	if remoteFs.Root != "" {
+		c.Meta.Ui.Output(fmt.Sprintf("Clients are confined to %s", remoteFs.Root))
+	}
+	for _, export := range remoteFs.Exports {
+		c.Meta.Ui.Output(fmt.Sprintf("Exporting %s as '%s' (%s)", export.Path, export.Name, export.Mode))
+	}
+	if remoteFs.ACL != nil {
+		c.Meta.Ui.Output(fmt.Sprintf("Access is restricted to %d client(s)", len(remoteFs.ACL)))
+	}
+	if daemon.MaxConnections > 0 {
+		c.Meta.Ui.Output(fmt.Sprintf("Serving at most %d client(s) at once", daemon.MaxConnections))
+	}
+	if daemon.LogFile != "" {
+		c.Meta.Ui.Output(fmt.Sprintf("Logging to %s", daemon.LogFile))
+	}
 }
 
 func (c *DaemonCommand) Help() string {
@@ -88,6 +297,25 @@ Options:
   --port                      The http(s) port to listen on
   --host                      The IP address to listen on. Defaults to 0.0.0.0
   --insecure				  Disable SSL security on the connection
+  --root                      Confine clients to a directory. Paths outside of it, including any reached through '..'
+                              or a symlink, are rejected. By default, clients can reach any path the daemon can
+  --export                    Serve a directory by name, as NAME=PATH[,MODE[,SUBJECT...]], so that mirror://host/NAME/foo
+                              is PATH/foo. MODE is rw (the default), ro or wo (files can be written, but not read back).
+                              If SUBJECTs are given, only clients whose certificate has one of them as its common name
+                              or subject may use it. May be given more than once. Clients can reach nothing else
+  --acl                       A file giving the rights of each client, one per line as NAME RIGHTS. NAME is the common
+                              name, subject or a subject alternative name of the client's certificate, or * for any
+                              client. RIGHTS is a comma separated list of read, write and delete. Clients that are
+                              not listed can do nothing
+  --config                    Read the configuration of the daemon from an HCL file, in place of the options above.
+                              It can also set the TLS certificates, logging, limits and hooks. See the README
+  --check-config              Check the file given by --config, and exit without starting the daemon
+  --shutdown-timeout          How long to wait for calls in progress to finish on SIGTERM, before disconnecting
+                              clients anyway. Defaults to 30s
+
+  On SIGTERM or interrupt, the daemon stops accepting clients, waits for calls in progress to finish, and exits.
+  On SIGHUP, it reads its configuration and certificates again, for clients that connect from then on. Clients
+  already connected are not disturbed.
 `
 
 	return strings.TrimSpace(helpText)
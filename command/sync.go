@@ -1,13 +1,19 @@
 package command
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"regexp"
+	"sort"
 	"strings"
 
+	"github.com/mefellows/mirror/filesystem"
+	"github.com/mefellows/mirror/filesystem/fs"
+	"github.com/mefellows/mirror/filesystem/s3"
+	"github.com/mefellows/mirror/mirror"
 	pki "github.com/mefellows/mirror/pki"
 	sync "github.com/mefellows/mirror/sync"
 )
@@ -22,6 +28,24 @@ type SyncCommand struct {
 	Key      string
 	Insecure bool
 	Watch    bool
+	WhatIf   bool
+	Delete   bool
+	Owner    bool
+	Symlinks string
+	Links    bool
+	Specials string
+	Xattrs   bool
+	TwoWay   bool
+	Conflict string
+	Checksum bool
+	HashAlgo string
+	Compare  string
+	Verify   bool
+	Output   string
+	Parallel int
+	PartSize int
+	S3Conc   int
+	Endpoint s3.EndpointConfig
 	Filters  []string
 	Exclude  ExcludeSlice
 	Verbose  bool
@@ -30,7 +54,7 @@ type SyncCommand struct {
 type ExcludeSlice []regexp.Regexp
 
 func (e *ExcludeSlice) String() string {
-	return fmt.Sprintf("%s", *e)
+	return fmt.Sprintf("%v", *e)
 }
 
 func (e *ExcludeSlice) Set(value string) error {
@@ -61,6 +85,26 @@ func (c *SyncCommand) Run(args []string) int {
 	cmdFlags.IntVar(&c.Port, "port", 8123, "The destination host")
 	cmdFlags.BoolVar(&c.Insecure, "insecure", false, "Run operation over an insecure connection")
 	cmdFlags.BoolVar(&c.Watch, "watch", false, "Watch for file updates, and continuously sync on changes from --src")
+	cmdFlags.BoolVar(&c.WhatIf, "whatif", false, "Print the changes that would be made to --dest, without making them")
+	cmdFlags.BoolVar(&c.Delete, "delete", false, "Delete files in --dest that do not exist in --src")
+	cmdFlags.BoolVar(&c.Owner, "preserve-owner", false, "Give files in --dest the same owner and group as in --src. Usually requires root")
+	cmdFlags.StringVar(&c.Symlinks, "symlinks", "preserve", "How symlinks are synced: preserve, follow or skip")
+	cmdFlags.BoolVar(&c.Links, "hard-links", false, "Recreate hard links in --src as hard links in --dest, rather than separate copies")
+	cmdFlags.StringVar(&c.Specials, "specials", "skip", "How FIFOs, sockets and device nodes are synced: skip or recreate")
+	cmdFlags.BoolVar(&c.Xattrs, "xattrs", false, "Sync extended attributes, including POSIX ACLs")
+	cmdFlags.BoolVar(&c.TwoWay, "two-way", false, "Synchronise changes in both directions between --src and --dest")
+	cmdFlags.StringVar(&c.Conflict, "conflict", "", "How to resolve conflicts in a two-way sync")
+	cmdFlags.BoolVar(&c.Checksum, "checksum", false, "Compare files by the hash of their contents, rather than modification time")
+	cmdFlags.StringVar(&c.HashAlgo, "checksum-algorithm", "sha256", "The hash algorithm used by --checksum and --verify: sha256 or md5")
+	cmdFlags.StringVar(&c.Compare, "compare", "", "Comma separated list of comparators used to detect changes: mtime, size, hash or exists")
+	cmdFlags.BoolVar(&c.Verify, "verify", false, "Check each copied file in --dest against the hash of the file in --src")
+	cmdFlags.IntVar(&c.Parallel, "parallel", 1, "The number of files to transfer at once")
+	cmdFlags.IntVar(&c.PartSize, "s3-part-size", int(s3.Transfer.PartSize/(1024*1024)), "The size in MB of each part of an S3 multipart upload or ranged download")
+	cmdFlags.IntVar(&c.S3Conc, "s3-concurrency", s3.Transfer.Concurrency, "The number of parts of an S3 multipart upload sent at once")
+	cmdFlags.StringVar(&c.Endpoint.URL, "s3-endpoint", "", "The URL of an S3-compatible endpoint to use instead of AWS e.g. http://localhost:9000")
+	cmdFlags.BoolVar(&c.Endpoint.PathStyle, "s3-path-style", false, "Address S3 buckets by path rather than by subdomain")
+	cmdFlags.BoolVar(&c.Endpoint.NoCredentials, "s3-no-credentials", false, "Don't load AWS credentials, for S3 endpoints that don't authenticate requests")
+	cmdFlags.StringVar(&c.Output, "output", "text", "The output format: text or json")
 	cmdFlags.BoolVar(&c.Verbose, "verbose", false, "Enable verbose output")
 	cmdFlags.Var(&c.Exclude, "exclude", "Set of exclusions as POSIX regular expressions to exclude from the transfer")
 
@@ -90,13 +134,81 @@ func (c *SyncCommand) Run(args []string) int {
 	}
 	pki.MirrorConfig.ClientTlsConfig = config
 
+	if c.Parallel < 1 {
+		c.Meta.Ui.Error("--parallel must be at least 1")
+		return 1
+	}
+
+	if int64(c.PartSize)*1024*1024 < s3.MinPartSize || c.S3Conc < 1 {
+		c.Meta.Ui.Error(fmt.Sprintf("--s3-part-size must be at least %dMB, and --s3-concurrency at least 1", s3.MinPartSize/(1024*1024)))
+		return 1
+	}
+	s3.Transfer.PartSize = int64(c.PartSize) * 1024 * 1024
+	s3.Transfer.Concurrency = c.S3Conc
+
+	if err := c.Endpoint.Validate(); err != nil {
+		c.Meta.Ui.Error(err.Error())
+		return 1
+	}
+	s3.Endpoint = c.Endpoint
+
+	symlinks, err := filesystem.NewSymlinkPolicy(c.Symlinks)
+	if err != nil {
+		c.Meta.Ui.Error(err.Error())
+		return 1
+	}
+	fs.Symlinks = symlinks
+	fs.Xattrs = c.Xattrs
+	s3.Xattrs = c.Xattrs
+
+	if c.Specials != "skip" && c.Specials != "recreate" {
+		c.Meta.Ui.Error(fmt.Sprintf("Unknown policy for special files '%s'. Available policies: skip, recreate", c.Specials))
+		return 1
+	}
+
+	if c.Output != "text" && c.Output != "json" {
+		c.Meta.Ui.Error(fmt.Sprintf("Unknown output format '%s'. Available formats: text, json", c.Output))
+		return 1
+	}
+
 	if !c.Verbose {
 		log.SetOutput(ioutil.Discard)
 	}
-	c.Meta.Ui.Output(fmt.Sprintf("Syncing contents of '%s' -> '%s'", c.Src, c.Dest))
+	if c.Output == "text" {
+		c.Meta.Ui.Output(fmt.Sprintf("Syncing contents of '%s' -> '%s'", c.Src, c.Dest))
+	}
 
-	options := &sync.Options{Exclude: c.Exclude, Verbose: c.Verbose}
-	err = sync.Sync(c.Src, c.Dest, options)
+	options := &sync.Options{Exclude: c.Exclude, Verbose: c.Verbose, Delete: c.Delete, Checksum: c.Checksum, HashAlgorithm: c.HashAlgo, Parallel: c.Parallel, PreserveOwner: c.Owner, HardLinks: c.Links, Specials: c.Specials == "recreate", Verify: c.Verify, Symlinks: symlinks}
+
+	if c.Compare != "" {
+		if c.Checksum {
+			c.Meta.Ui.Error("--checksum can not be used with --compare; add hash to --compare instead")
+			return 1
+		}
+		options.Compare = strings.Split(c.Compare, ",")
+		if _, err := filesystem.NewComparators(options.Compare, nil, nil, c.HashAlgo); err != nil {
+			c.Meta.Ui.Error(err.Error())
+			return 1
+		}
+	}
+
+	if c.Output == "json" {
+		return c.runJSON(options)
+	}
+
+	if c.WhatIf {
+		return c.runWhatIf(options)
+	}
+
+	if c.TwoWay {
+		return c.runTwoWay(options)
+	}
+
+	if c.Verify {
+		err = c.syncVerified(options)
+	} else {
+		err = sync.Sync(c.Src, c.Dest, options)
+	}
 
 	if c.Watch {
 		c.Meta.Ui.Output(fmt.Sprintf("Monitoring %s for changes...", c.Src))
@@ -111,6 +223,104 @@ func (c *SyncCommand) Run(args []string) int {
 	return 0
 }
 
+// Sync, then report how many of the copied files were verified
+func (c *SyncCommand) syncVerified(options *sync.Options) error {
+	plan, err := sync.NewPlan(c.Src, c.Dest, options)
+	if err != nil {
+		return err
+	}
+	result, err := plan.Execute()
+	c.Meta.Ui.Output(fmt.Sprintf("%d file(s) verified, %d failed verification", result.Verified, result.VerifyFailed))
+	return err
+}
+
+// Print the Operations a sync would perform, without performing them
+func (c *SyncCommand) runWhatIf(options *sync.Options) int {
+	if c.TwoWay || c.Watch {
+		c.Meta.Ui.Error("--whatif is not supported with --two-way or --watch")
+		return 1
+	}
+	plan, err := sync.NewPlan(c.Src, c.Dest, options)
+	if err != nil {
+		c.Meta.Ui.Error(fmt.Sprintf("Error planning file sync: %v", err))
+		return 1
+	}
+	for _, op := range plan.Operations {
+		c.Meta.Ui.Output(op.String())
+	}
+	c.Meta.Ui.Output(fmt.Sprintf("%d operation(s) would be performed", len(plan.Operations)))
+	return 0
+}
+
+// Print the planned, or executed, Operations as a JSON document
+func (c *SyncCommand) runJSON(options *sync.Options) int {
+	if c.TwoWay || c.Watch {
+		c.Meta.Ui.Error("--output json is not supported with --two-way or --watch")
+		return 1
+	}
+	plan, err := sync.NewPlan(c.Src, c.Dest, options)
+	if err != nil {
+		c.Meta.Ui.Error(fmt.Sprintf("Error planning file sync: %v", err))
+		return 1
+	}
+
+	var result *sync.Result
+	if c.WhatIf {
+		result = plan.WhatIf()
+	} else {
+		result, err = plan.Execute()
+	}
+	data, jsonErr := json.MarshalIndent(result, "", "  ")
+	if jsonErr != nil {
+		c.Meta.Ui.Error(fmt.Sprintf("Error writing sync result: %v", jsonErr))
+		return 1
+	}
+	c.Meta.Ui.Output(string(data))
+
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+func (c *SyncCommand) runTwoWay(options *sync.Options) int {
+	if c.Watch {
+		c.Meta.Ui.Error("--watch is not supported with --two-way")
+		return 1
+	}
+	if c.Verify {
+		c.Meta.Ui.Error("--verify is not supported with --two-way")
+		return 1
+	}
+
+	if c.Conflict != "" {
+		resolver, ok := mirror.ConflictResolvers.Lookup(c.Conflict)
+		if !ok {
+			names := mirror.ConflictResolvers.Names()
+			sort.Strings(names)
+			c.Meta.Ui.Error(fmt.Sprintf("Unknown conflict resolver '%s'. Available resolvers: %s", c.Conflict, strings.Join(names, ", ")))
+			return 1
+		}
+		options.Resolver = resolver
+	}
+
+	conflicts, err := sync.SyncTwoWay(c.Src, c.Dest, options)
+	if err != nil {
+		c.Meta.Ui.Error(fmt.Sprintf("Error during file sync: %v", err))
+		return 1
+	}
+
+	for _, conflict := range conflicts {
+		c.Meta.Ui.Warn(fmt.Sprintf("Conflict: '%s' was changed in both '%s' and '%s'", conflict.Path, c.Src, c.Dest))
+	}
+	if len(conflicts) > 0 {
+		c.Meta.Ui.Error(fmt.Sprintf("%d conflict(s) were not synchronised", len(conflicts)))
+		return 1
+	}
+
+	return 0
+}
+
 func (c *SyncCommand) Help() string {
 	helpText := `
 Usage: mirror sync [options]
@@ -121,7 +331,8 @@ Options:
 
   --src                       The source directory from which to copy from
   --dest                      The destination directory from which to copy to
-  --whatif                    Runs the sync operation as a dry-run (similar to the -n rsync flag)
+  --whatif                    Runs the sync operation as a dry-run (similar to the -n rsync flag), printing each mkdir, copy,
+                              update, delete and chmod that would be made to the destination
   --host                      The remote host to sync the files/folders with. Defaults to 'localhost'
   --port                      The port on the remote host to connect to. Defaults to 8123
   --insecure          		  The file transfer should be performed over an unencrypted connection
@@ -129,7 +340,47 @@ Options:
   --key                       The key (.pem) to use in secure requests
   --exclude                   A regular expression used to exclude files and directories that match. Can be specified multiple times.
                               This is a special option that may be specified multiple times
+  --delete                    Delete files in the destination that do not exist in the source. Files matching --exclude are kept
+  --preserve-owner            Give files in the destination the same owner and group as the source, by numeric id.
+                              Changing the owner of a file usually requires root. Permissions and modification times
+                              are always preserved
+  --symlinks                  How symlinks in the source are synced. preserve (the default) recreates them as links with the
+                              same target, follow syncs whatever they point to in their place, and skip leaves them out.
+                              Links are skipped for destinations that cannot hold them, such as S3
+  --hard-links                Files hard linked to one another in the source are linked in the destination too, rather than
+                              copied separately
+  --specials                  How FIFOs, sockets and device nodes are synced: skip (the default) or recreate. Their contents
+                              are never read. Creating device nodes usually requires root
+  --xattrs                    Sync extended attributes, which include POSIX ACLs and file capabilities. Only supported
+                              on Linux. On S3 they are stored as object metadata, and reading them takes a request per object
+  --two-way                   Synchronise changes in both directions. The state of each sync is recorded in $MIRROR_HOME/state,
+                              and paths changed on both sides since the last sync are reported as conflicts
+  --conflict                  How to resolve two-way sync conflicts: newest-wins, source-wins, dest-wins, keep-both or fail.
+                              By default, conflicts are reported and left untouched
+  --checksum                  Compare files by the hash of their contents instead of their modification time. Remote hosts
+                              calculate hashes themselves, and S3 uses the ETag where it is an MD5
+  --checksum-algorithm        The hash algorithm used by --checksum and --verify: sha256 (default) or md5
+  --compare                   Comma separated list of comparators used to detect changed files, e.g. --compare=mtime,size.
+                              A file is copied if any comparator finds a difference. One of: mtime (default), size,
+                              hash (as --checksum) or exists (only copy files missing from the destination). Can't be
+                              used with --checksum; add hash to the list instead
+  --verify                    After copying each file, hash it in the destination and check it against the source. Remote
+                              hosts calculate hashes themselves, and S3 uses the ETag where it is an MD5, so use
+                              --checksum-algorithm md5 to avoid reading objects back. A file that does not match is sent
+                              again, up to 3 times, before it is reported as failed
   --watch                     Watch for changes in source directory and continuously sync to dest
+  --parallel                  The number of files to transfer at once. Defaults to 1. Directories are always created before
+                              their contents
+  --s3-part-size              S3 objects larger than this many MB are uploaded in parts, and downloaded in ranges of this
+                              size. Defaults to 16, and must be at least 5
+  --s3-concurrency            The number of parts of an S3 upload sent at once. Defaults to 4
+  --s3-endpoint               The URL of an S3-compatible store to use instead of AWS, such as MinIO or Ceph
+                              e.g. http://localhost:9000. Endpoints given as http:// are not encrypted
+  --s3-path-style             Address buckets by path (http://host/bucket/key) rather than by subdomain
+  --s3-no-credentials         Don't load AWS credentials, for local S3 endpoints that don't authenticate requests. Requests
+                              are still signed, with an empty key, so endpoints that check signatures reject them
+  --output                    The output format: text (default) or json. With json, a document listing each planned or
+                              executed operation, the bytes transferred, per-file errors and durations is printed
   --verbose                   Enable output logging
 `
 
@@ -1,5 +1,11 @@
 package filesystem
 
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
 // A function that returns true iff the src and dest files are the same
 // based on their definition
 type FileComparator func(src File, dest File) bool
@@ -11,3 +17,68 @@ var ModifiedComparator = func(src File, dest File) bool {
 	}
 	return true
 }
+
+// Compares the size of the File. Directories are the same as one another.
+var SizeComparator = func(src File, dest File) bool {
+	if dest.Name() == "" || src.IsDir() != dest.IsDir() {
+		return false
+	}
+	return src.IsDir() || src.Size() == dest.Size()
+}
+
+// Only checks that the File exists at the destination, never replacing
+// one that is already there
+var ExistsComparator = func(src File, dest File) bool {
+	return dest.Name() != "" && src.IsDir() == dest.IsDir()
+}
+
+// Compares the contents of the File, by hash.
+//
+// As this requires access to the contents of each File, the comparator
+// is bound to the FileSystems being compared. Files of differing sizes
+// are known to be different without hashing them.
+func HashComparator(srcFs FileSystem, destFs FileSystem, algorithm string) FileComparator {
+	return func(src File, dest File) bool {
+		if dest.Name() == "" {
+			return false
+		}
+		// Only regular files have contents to hash. Reading anything else
+		// could block, as with a FIFO.
+		if !src.Mode().IsRegular() || !dest.Mode().IsRegular() {
+			return src.Mode()&os.ModeType == dest.Mode()&os.ModeType
+		}
+		if src.Size() != dest.Size() {
+			return false
+		}
+		srcHash, err := FileHash(srcFs, src, algorithm)
+		if err != nil {
+			return false
+		}
+		destHash, err := FileHash(destFs, dest, algorithm)
+		if err != nil {
+			return false
+		}
+		return srcHash == destHash
+	}
+}
+
+// Build a chain of FileComparators from their names: mtime, size, hash
+// or exists. A File is different if any comparator in the chain says so.
+func NewComparators(names []string, srcFs FileSystem, destFs FileSystem, algorithm string) ([]FileComparator, error) {
+	comparators := make([]FileComparator, 0, len(names))
+	for _, name := range names {
+		switch strings.TrimSpace(name) {
+		case "mtime":
+			comparators = append(comparators, ModifiedComparator)
+		case "size":
+			comparators = append(comparators, SizeComparator)
+		case "hash":
+			comparators = append(comparators, HashComparator(srcFs, destFs, algorithm))
+		case "exists":
+			comparators = append(comparators, ExistsComparator)
+		default:
+			return nil, fmt.Errorf("Unknown comparator '%s'. Available comparators: mtime, size, hash, exists", name)
+		}
+	}
+	return comparators, nil
+}
@@ -1,6 +1,7 @@
 package filesystem
 
 import (
+	"os"
 	"testing"
 	"time"
 )
@@ -25,3 +26,89 @@ func TestModifiedComparator(t *testing.T) {
 		t.Fatalf("Expect files to be different, got newFile: %s and oldFile: %s", newFile.ModTime(), oldFile.ModTime())
 	}
 }
+
+func TestHashComparator(t *testing.T) {
+	srcFs := MockFileSystem{ReadBytes: []byte("hello\ngo\n")}
+	sameFs := MockFileSystem{ReadBytes: []byte("hello\ngo\n")}
+	otherFs := MockFileSystem{ReadBytes: []byte("hello\nGO\n")}
+
+	src := File{FileName: "bar", FilePath: "/foo/bar", FileSize: 9, FileModTime: time.Now()}
+	dest := File{FileName: "bar", FilePath: "/baz/bar", FileSize: 9}
+
+	if !HashComparator(srcFs, sameFs, SHA256)(src, dest) {
+		t.Fatalf("Expected files with the same contents to be the same, regardless of modified time")
+	}
+	if HashComparator(srcFs, otherFs, SHA256)(src, dest) {
+		t.Fatalf("Expected files with different contents to be different")
+	}
+	if HashComparator(srcFs, sameFs, SHA256)(src, File{}) {
+		t.Fatalf("Expected a missing file to be different")
+	}
+	if HashComparator(srcFs, sameFs, "crc32")(src, dest) {
+		t.Fatalf("Expected an unsupported algorithm to be treated as different")
+	}
+}
+
+func TestFileHash(t *testing.T) {
+	fs := MockFileSystem{ReadBytes: []byte("hello\ngo\n")}
+	hash, err := FileHash(fs, File{}, MD5)
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if hash != "4738662f38bc4f828efb2e55a4705c1c" {
+		t.Fatalf("Expected an MD5 hash, got %s", hash)
+	}
+}
+
+func TestSizeComparator(t *testing.T) {
+	file := File{FileName: "bar", FilePath: "/foo/bar", FileSize: 1024}
+	same := File{FileName: "bar", FilePath: "/baz/bar", FileSize: 1024, FileModTime: time.Now()}
+	bigger := File{FileName: "bar", FilePath: "/baz/bar", FileSize: 2048}
+
+	if !SizeComparator(file, same) {
+		t.Fatalf("Expected files of the same size to be the same")
+	}
+	if SizeComparator(file, bigger) {
+		t.Fatalf("Expected files of different sizes to be different")
+	}
+	if SizeComparator(file, File{}) {
+		t.Fatalf("Expected a missing file to be different")
+	}
+}
+
+func TestExistsComparator(t *testing.T) {
+	file := File{FileName: "bar", FilePath: "/foo/bar", FileSize: 1024}
+	other := File{FileName: "bar", FilePath: "/baz/bar", FileSize: 1}
+	dir := File{FileName: "bar", FilePath: "/baz/bar", FileMode: os.ModeDir}
+
+	if !ExistsComparator(file, other) {
+		t.Fatalf("Expected an existing file to be the same")
+	}
+	if ExistsComparator(file, File{}) {
+		t.Fatalf("Expected a missing file to be different")
+	}
+	if ExistsComparator(file, dir) {
+		t.Fatalf("Expected a directory to differ from a file")
+	}
+}
+
+func TestNewComparators(t *testing.T) {
+	comparators, err := NewComparators([]string{"mtime", "size"}, nil, nil, SHA256)
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if len(comparators) != 2 {
+		t.Fatalf("Expected 2 comparators, got %d", len(comparators))
+	}
+
+	src := map[string]File{"bar": File{FileName: "bar", FilePath: "/foo/bar", FileSize: 2048}}
+	dest := map[string]File{"bar": File{FileName: "bar", FilePath: "/baz/bar", FileSize: 1024, FileModTime: time.Now()}}
+	diff, _ := FileMapDiff(src, dest, comparators...)
+	if len(diff) != 1 {
+		t.Fatalf("Expected a newer dest of a different size to be copied, got %v", diff)
+	}
+
+	if _, err = NewComparators([]string{"mtime", "colour"}, nil, nil, SHA256); err == nil {
+		t.Fatalf("Expected err for an unknown comparator")
+	}
+}
@@ -0,0 +1,34 @@
+package delta
+
+// Adler-32 style checksum, as used by rsync, that can be cheaply
+// "rolled" along a File one byte at a time.
+//
+// The two 16-bit sums are kept in 32-bit accumulators; as 2^16 divides
+// 2^32 the low 16 bits remain correct through unsigned overflow.
+type rollingChecksum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingChecksum(window []byte) *rollingChecksum {
+	sum := &rollingChecksum{n: uint32(len(window))}
+	for i, c := range window {
+		sum.a += uint32(c)
+		sum.b += (sum.n - uint32(i)) * uint32(c)
+	}
+	return sum
+}
+
+// Slide the window one byte along, removing out and adding in
+func (s *rollingChecksum) roll(out byte, in byte) {
+	s.a = s.a - uint32(out) + uint32(in)
+	s.b = s.b - s.n*uint32(out) + s.a
+}
+
+func (s *rollingChecksum) value() uint32 {
+	return (s.a & 0xffff) | (s.b << 16)
+}
+
+func weakChecksum(block []byte) uint32 {
+	return newRollingChecksum(block).value()
+}
@@ -0,0 +1,264 @@
+// Block-level delta encoding, based on the rsync algorithm.
+//
+// The receiver of a File computes a Signature of its (old) copy: a weak,
+// rolling checksum and a strong hash for each fixed-size block. The sender
+// then slides a window over its (new) copy, looking up the rolling checksum
+// at every byte offset, and emits a stream of Operations that either
+// reference a block the receiver already has, or carry literal data.
+// Finally, the receiver applies the Operations against its old copy with a
+// Patcher to reconstruct the new File.
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"io"
+	"math"
+)
+
+// Default size of the blocks a File is divided into
+const DefaultBlockSize = 8 * 1024
+
+const (
+	minBlockSize = 2 * 1024
+	maxBlockSize = 128 * 1024
+)
+
+// The maximum amount of literal data buffered before it is emitted
+const maxLiteralSize = 256 * 1024
+
+// Calculates a block size for a File of the given size.
+//
+// Like rsync, this grows with the square root of the File size so that
+// the Signature of a large File remains small.
+func BlockSize(size int64) int {
+	blockSize := int(math.Sqrt(float64(size)))
+	switch {
+	case blockSize < minBlockSize:
+		return minBlockSize
+	case blockSize > maxBlockSize:
+		return maxBlockSize
+	}
+	return blockSize
+}
+
+// Checksums of a single block of a File
+type BlockSignature struct {
+	Index  int64  // Position of the block in the File, in blocks
+	Weak   uint32 // Rolling checksum of the block
+	Strong []byte // MD5 of the block
+}
+
+// The Signature of a File is the set of checksums of its blocks
+type Signature struct {
+	BlockSize int
+	Blocks    []BlockSignature
+}
+
+type OpType int
+
+const (
+	OpBlock OpType = iota // Copy a block from the receivers' copy of the File
+	OpData                // Write literal data
+)
+
+// A single instruction for reconstructing a File
+type Operation struct {
+	Type  OpType
+	Index int64  // Block to copy, for OpBlock
+	Data  []byte // Literal data, for OpData
+}
+
+// Receives Operations as they are produced by Delta
+type OpWriter interface {
+	WriteOp(op Operation) error
+}
+
+// Applies Operations to a File, replacing it on Close.
+// Abort discards the Operations written so far, leaving the File untouched.
+type PatchWriter interface {
+	OpWriter
+	Close() error
+	Abort() error
+}
+
+// Computes the Signature of the contents of r.
+func NewSignature(r io.Reader, blockSize int) (*Signature, error) {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	sig := &Signature{BlockSize: blockSize, Blocks: make([]BlockSignature, 0)}
+	block := make([]byte, blockSize)
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			strong := md5.Sum(block[:n])
+			sig.Blocks = append(sig.Blocks, BlockSignature{
+				Index:  index,
+				Weak:   weakChecksum(block[:n]),
+				Strong: strong[:],
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Computes the Operations required to turn the File described by sig
+// into the contents of r, writing each to w as it is found.
+//
+// Memory use is bounded by the block size and the maximum literal size,
+// regardless of the size of r.
+func Delta(sig *Signature, r io.Reader, w OpWriter) error {
+	blockSize := sig.BlockSize
+	table := make(map[uint32][]BlockSignature)
+	for _, block := range sig.Blocks {
+		table[block.Weak] = append(table[block.Weak], block)
+	}
+
+	// buf holds pending literal data (buf[:start]), followed by the
+	// current window (buf[start:])
+	buf := make([]byte, 0, maxLiteralSize+blockSize)
+	start := 0
+	br := bufio.NewReader(r)
+
+	emitLiteral := func(data []byte) error {
+		if len(data) == 0 {
+			return nil
+		}
+		literal := make([]byte, len(data))
+		copy(literal, data)
+		return w.WriteOp(Operation{Type: OpData, Data: literal})
+	}
+
+	// Fill the window with the next block from r
+	fill := func() (bool, error) {
+		n, err := io.ReadFull(br, buf[len(buf):len(buf)+blockSize])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	full, err := fill()
+	if err != nil {
+		return err
+	}
+	sum := newRollingChecksum(buf[start:])
+
+	for full {
+		window := buf[start:]
+		if index, ok := match(table, sum.value(), window); ok {
+			if err := emitLiteral(buf[:start]); err != nil {
+				return err
+			}
+			if err := w.WriteOp(Operation{Type: OpBlock, Index: index}); err != nil {
+				return err
+			}
+			buf = buf[:0]
+			start = 0
+			if full, err = fill(); err != nil {
+				return err
+			}
+			sum = newRollingChecksum(buf)
+			continue
+		}
+
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		sum.roll(buf[start], c)
+		buf = append(buf, c)
+		start++
+
+		if start >= maxLiteralSize {
+			if err := emitLiteral(buf[:start]); err != nil {
+				return err
+			}
+			n := copy(buf, buf[start:])
+			buf = buf[:n]
+			start = 0
+		}
+	}
+
+	// Whatever remains is shorter than a block, but may still match the
+	// (short) final block of the File
+	window := buf[start:]
+	if len(window) > 0 && len(window) < blockSize {
+		if index, ok := match(table, weakChecksum(window), window); ok {
+			if err := emitLiteral(buf[:start]); err != nil {
+				return err
+			}
+			return w.WriteOp(Operation{Type: OpBlock, Index: index})
+		}
+	}
+	return emitLiteral(buf)
+}
+
+// Find a block with the given checksum, confirming the match with the strong hash
+func match(table map[uint32][]BlockSignature, weak uint32, window []byte) (int64, bool) {
+	candidates, ok := table[weak]
+	if !ok {
+		return 0, false
+	}
+	strong := md5.Sum(window)
+	for _, block := range candidates {
+		if bytes.Equal(block.Strong, strong[:]) {
+			return block.Index, true
+		}
+	}
+	return 0, false
+}
+
+// Reads r for as long as it matches the whole blocks of sig, in order from
+// the start, and returns the length of the matching prefix. The block that
+// did not match has already been read from r, so it is returned too.
+func MatchPrefix(sig *Signature, r io.Reader) (int64, []byte, error) {
+	var offset int64
+	block := make([]byte, sig.BlockSize)
+	for i, b := range sig.Blocks {
+		n, err := io.ReadFull(r, block)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return offset, nil, err
+		}
+		strong := md5.Sum(block[:n])
+		if n < len(block) || b.Index != int64(i) || !bytes.Equal(b.Strong, strong[:]) {
+			return offset, block[:n], nil
+		}
+		offset += int64(n)
+	}
+	return offset, nil, nil
+}
+
+// Reconstructs a File from a base copy and a stream of Operations
+type Patcher struct {
+	base      io.ReaderAt
+	blockSize int
+	w         io.Writer
+}
+
+func NewPatcher(base io.ReaderAt, blockSize int, w io.Writer) *Patcher {
+	return &Patcher{base: base, blockSize: blockSize, w: w}
+}
+
+func (p *Patcher) WriteOp(op Operation) error {
+	var err error
+	switch op.Type {
+	case OpBlock:
+		block := io.NewSectionReader(p.base, op.Index*int64(p.blockSize), int64(p.blockSize))
+		_, err = io.Copy(p.w, block)
+	case OpData:
+		_, err = p.w.Write(op.Data)
+	}
+	return err
+}
@@ -0,0 +1,170 @@
+package delta
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+type opRecorder struct {
+	ops []Operation
+}
+
+func (r *opRecorder) WriteOp(op Operation) error {
+	r.ops = append(r.ops, op)
+	return nil
+}
+
+func (r *opRecorder) literalBytes() int {
+	total := 0
+	for _, op := range r.ops {
+		if op.Type == OpData {
+			total += len(op.Data)
+		}
+	}
+	return total
+}
+
+// Run a full signature -> delta -> patch cycle, returning the reconstructed
+// data and the operations used
+func roundTrip(t *testing.T, old []byte, new []byte, blockSize int) ([]byte, *opRecorder) {
+	sig, err := NewSignature(bytes.NewReader(old), blockSize)
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	ops := &opRecorder{}
+	if err = Delta(sig, bytes.NewReader(new), ops); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	var out bytes.Buffer
+	patcher := NewPatcher(bytes.NewReader(old), blockSize, &out)
+	for _, op := range ops.ops {
+		if err = patcher.WriteOp(op); err != nil {
+			t.Fatalf("Did not expect err: %v", err)
+		}
+	}
+	return out.Bytes(), ops
+}
+
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+	return data
+}
+
+func TestRollingChecksum(t *testing.T) {
+	data := randomBytes(1000)
+	sum := newRollingChecksum(data[:100])
+	for i := 0; i < 900; i++ {
+		sum.roll(data[i], data[i+100])
+		if sum.value() != weakChecksum(data[i+1:i+101]) {
+			t.Fatalf("Rolling checksum diverged at offset %d", i+1)
+		}
+	}
+}
+
+func TestDelta_Identical(t *testing.T) {
+	data := randomBytes(100 * 1024)
+	out, ops := roundTrip(t, data, data, 4096)
+	if !bytes.Equal(out, data) {
+		t.Fatalf("Expected patched data to match")
+	}
+	if ops.literalBytes() != 0 {
+		t.Fatalf("Expected no literal data for identical files, got %d bytes", ops.literalBytes())
+	}
+}
+
+func TestDelta_SmallChange(t *testing.T) {
+	old := randomBytes(100*1024 + 17)
+	new := make([]byte, len(old))
+	copy(new, old)
+	new[50000] ^= 0xff
+
+	out, ops := roundTrip(t, old, new, 4096)
+	if !bytes.Equal(out, new) {
+		t.Fatalf("Expected patched data to match")
+	}
+	if ops.literalBytes() > 4096 {
+		t.Fatalf("Expected at most one block of literal data, got %d bytes", ops.literalBytes())
+	}
+}
+
+func TestDelta_Insertion(t *testing.T) {
+	old := randomBytes(64 * 1024)
+	new := append(append(append([]byte{}, old[:1000]...), []byte("inserted")...), old[1000:]...)
+
+	out, ops := roundTrip(t, old, new, 1024)
+	if !bytes.Equal(out, new) {
+		t.Fatalf("Expected patched data to match")
+	}
+	if ops.literalBytes() > 2*1024 {
+		t.Fatalf("Expected the rolling checksum to resynchronise after the insertion, got %d literal bytes", ops.literalBytes())
+	}
+}
+
+func TestDelta_Unrelated(t *testing.T) {
+	old := randomBytes(10 * 1024)
+	new := randomBytes(600 * 1024)
+	out, _ := roundTrip(t, old, new, 2048)
+	if !bytes.Equal(out, new) {
+		t.Fatalf("Expected patched data to match")
+	}
+}
+
+func TestDelta_Empty(t *testing.T) {
+	out, _ := roundTrip(t, randomBytes(1024), []byte{}, 2048)
+	if len(out) != 0 {
+		t.Fatalf("Expected empty output, got %d bytes", len(out))
+	}
+	out, _ = roundTrip(t, []byte{}, []byte("foo"), 2048)
+	if string(out) != "foo" {
+		t.Fatalf("Expected 'foo', got %s", out)
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	if BlockSize(0) != minBlockSize {
+		t.Fatalf("Expected minimum block size for an empty file, got %d", BlockSize(0))
+	}
+	if BlockSize(1<<40) != maxBlockSize {
+		t.Fatalf("Expected maximum block size for a huge file, got %d", BlockSize(1<<40))
+	}
+	if BlockSize(1<<30) != 32768 {
+		t.Fatalf("Expected block size of 32768 for a 1GB file, got %d", BlockSize(1<<30))
+	}
+}
+
+func TestMatchPrefix(t *testing.T) {
+	blockSize := 1024
+	data := randomBytes(10 * blockSize)
+
+	// A partial copy, with a torn final block
+	partial := append([]byte{}, data[:3*blockSize+100]...)
+	sig, _ := NewSignature(bytes.NewReader(partial), blockSize)
+	r := bytes.NewReader(data)
+	offset, rest, err := MatchPrefix(sig, r)
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if offset != int64(3*blockSize) {
+		t.Fatalf("Expected prefix of %d bytes to match, got %d", 3*blockSize, offset)
+	}
+	if !bytes.Equal(rest, data[3*blockSize:4*blockSize]) {
+		t.Fatalf("Expected the unmatched block to be returned")
+	}
+	if r.Len() != 6*blockSize {
+		t.Fatalf("Expected reading to stop after the unmatched block, %d bytes left", r.Len())
+	}
+
+	// A partial copy of something else
+	partial[blockSize+1]++
+	sig, _ = NewSignature(bytes.NewReader(partial), blockSize)
+	if offset, _, _ = MatchPrefix(sig, bytes.NewReader(data)); offset != int64(blockSize) {
+		t.Fatalf("Expected prefix of %d bytes to match, got %d", blockSize, offset)
+	}
+
+	sig, _ = NewSignature(bytes.NewReader(nil), blockSize)
+	if offset, rest, _ = MatchPrefix(sig, bytes.NewReader(data)); offset != 0 || rest != nil {
+		t.Fatalf("Expected nothing to match an empty partial copy, got %d bytes", offset)
+	}
+}
@@ -1,35 +1,126 @@
 package filesystem
 
 import (
+	"bytes"
+	"io"
 	"os"
 	"time"
+
+	"github.com/mefellows/mirror/filesystem/delta"
 )
 
 // Generic File System abstraction
 type FileSystem interface {
-	Dir(string) ([]File, error)                           // Read the contents of a directory
-	Read(File) ([]byte, error)                            // Read a File
-	ReadFile(file string) (File, error)                   // Read a file and return a File
-	Write(file File, data []byte, perm os.FileMode) error // Write a File
-	FileTree(root File) *FileTree                         // Returns a FileTree structure of Files representing the FileSystem hierarchy
-	FileMap(root File) FileMap                            // Returns a FileMap structure of Files representing a flattened FileSystem hierarchy
+	Dir(string) ([]File, error)                                 // Read the contents of a directory
+	Read(File) ([]byte, error)                                  // Read a File
+	ReadFile(file string) (File, error)                         // Read a file and return a File
+	Write(file File, data []byte, perm os.FileMode) error       // Write a File
+	Open(file File) (io.ReadCloser, error)                      // Open a File for streaming reads
+	Create(file File, perm os.FileMode) (io.WriteCloser, error) // Create (or truncate) a File for streaming writes
+	FileTree(root File) *FileTree                               // Returns a FileTree structure of Files representing the FileSystem hierarchy
+	FileMap(root File) (FileMap, error)                         // Returns a FileMap structure of Files representing a flattened FileSystem hierarchy
 	MkDir(file File) error
 	Delete(file string) error // Delete a file on the FileSystem
 }
 
+// A FileSystem that can bring an existing File up to date by applying a
+// block-level delta, rather than receiving the whole File again
+type DeltaFileSystem interface {
+	FileSystem
+	Signature(file File, blockSize int) (*delta.Signature, error)                // Compute the block Signature of an existing File
+	Patch(file File, perm os.FileMode, blockSize int) (delta.PatchWriter, error) // Rewrite a File from delta Operations against its current contents
+}
+
+// A FileSystem that keeps what was written of a File when a transfer is
+// interrupted, so that the next transfer can carry on from where it stopped
+type ResumeFileSystem interface {
+	FileSystem
+	PartialSignature(file File, blockSize int) (*delta.Signature, error)                      // Signature of what was written of file by an interrupted transfer, with no Blocks if there is none
+	Resume(file File, perm os.FileMode, offset int64, algorithm string) (ResumeWriter, error) // Carry on writing file from offset, discarding anything written after it, and hashing the whole File with algorithm
+}
+
+// Writes the rest of a File whose transfer is being resumed
+type ResumeWriter interface {
+	io.Writer
+	Commit(sum string) error // Check the hash of the whole File against that of the source, replacing file with it if it matches and discarding it if not
+	Abort() error            // Stop writing, keeping what was written so far to resume from
+}
+
+// A FileSystem that can change the permissions of an existing File
+type ChmodFileSystem interface {
+	FileSystem
+	Chmod(file File, perm os.FileMode) error
+}
+
+// A FileSystem that can create hard links
+type HardLinkFileSystem interface {
+	FileSystem
+	Link(file File, existing File) error // Make file a hard link to existing, replacing any File already there
+}
+
+// A FileSystem that can create FIFOs, sockets and device nodes
+type SpecialFileSystem interface {
+	FileSystem
+	Mknod(file File) error // Create a special File of the type, permissions and FileRdev of file
+}
+
+// A FileSystem that can store the extended attributes of a File
+type XattrFileSystem interface {
+	FileSystem
+	SetXattrs(file File, attrs Xattrs) error // Replace every extended attribute of an existing File
+}
+
+// A writer returned by Create that can be abandoned part way through,
+// leaving any File already there as it was
+type AbortWriter interface {
+	io.WriteCloser
+	Abort() error // Discard everything written so far
+}
+
+// Extended attributes of a File, by name
+type Xattrs map[string][]byte
+
+// Whether two sets of attributes are the same. Having none is the same as
+// not having read them.
+func (x Xattrs) Equal(other Xattrs) bool {
+	if len(x) != len(other) {
+		return false
+	}
+	for name, value := range x {
+		if v, ok := other[name]; !ok || !bytes.Equal(v, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// A FileSystem that can change the ownership of an existing File
+type ChownFileSystem interface {
+	FileSystem
+	Chown(file File, owner int, group int) error
+}
+
 type FileMap map[string]File
 
 // Simple File abstraction (based on os.FileInfo)
 //
 // All local and remote files will be represented as a File.
 // It is up to the specific FileSystem implementation to uphold this
-//
 type File struct {
 	FileName    string      // base name of the file
 	FilePath    string      // Full path to file, including filename
 	FileSize    int64       // length in bytes for regular files; system-dependent for others
 	FileModTime time.Time   // modification time
 	FileMode    os.FileMode // File details including perms
+	FileOwner   int         // numeric id of the user that owns the file
+	FileGroup   int         // numeric id of the group that owns the file
+	HasOwner    bool        // whether the FileSystem reports ownership, as not all of them do
+	FileLink    string      // target of the file, if it is a symbolic link
+	FileDev     uint64      // device containing the file
+	FileInode   uint64      // inode of the file. Hard links share an inode on the same FileDev
+	FileNlink   uint64      // number of hard links to the file, or 0 if unknown
+	FileRdev    uint64      // device number, if the file is a device node
+	FileXattrs  Xattrs      // extended attributes, including POSIX ACLs. nil unless the FileSystem was asked to read them
 }
 
 func (f File) Name() string {
@@ -52,10 +143,36 @@ func (f File) IsDir() bool {
 	return f.Mode().IsDir()
 }
 
+func (f File) IsSymlink() bool {
+	return f.Mode()&os.ModeSymlink != 0
+}
+
+// A FIFO, socket or device node, which has no contents to copy
+func (f File) IsSpecial() bool {
+	return f.Mode()&(os.ModeNamedPipe|os.ModeSocket|os.ModeDevice|os.ModeCharDevice) != 0
+}
+
+// Whether other hard links share this File's contents
+func (f File) IsHardLink() bool {
+	return f.Mode().IsRegular() && f.FileNlink > 1
+}
+
+func (f File) LinkTarget() string {
+	return f.FileLink
+}
+
 func (f File) Mode() os.FileMode {
 	return f.FileMode
 }
 
+func (f File) Owner() int {
+	return f.FileOwner
+}
+
+func (f File) Group() int {
+	return f.FileGroup
+}
+
 func (f File) Sys() interface{} {
 	return nil
 }
@@ -1,6 +1,9 @@
 package filesystem
 
 import (
+	"bytes"
+	"io"
+	"io/ioutil"
 	"os"
 	"time"
 )
@@ -9,13 +12,15 @@ type MockFileSystem struct {
 	ReadBytes []byte
 	ReadError error
 
-	WriteError error
+	WriteError   error
+	CreateWriter io.WriteCloser
 
 	DirFiles []File
 	DirError error
 
 	FileTreeTree  *FileTree
 	FileMapMap    FileMap
+	FileMapError  error
 	MockFile      File
 	MockFileError error
 }
@@ -45,8 +50,16 @@ func (fs MockFileSystem) Write(File, []byte, os.FileMode) error {
 	return fs.WriteError
 }
 
-func (fs MockFileSystem) FileMap(root File) FileMap {
-	return fs.FileMapMap
+func (fs MockFileSystem) Open(File) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(fs.ReadBytes)), fs.ReadError
+}
+
+func (fs MockFileSystem) Create(File, os.FileMode) (io.WriteCloser, error) {
+	return fs.CreateWriter, fs.WriteError
+}
+
+func (fs MockFileSystem) FileMap(root File) (FileMap, error) {
+	return fs.FileMapMap, fs.FileMapError
 }
 
 func (fs MockFileSystem) FileTree(root File) *FileTree {
@@ -2,10 +2,13 @@ package fs
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	neturl "net/url"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/mefellows/mirror/filesystem"
 	utils "github.com/mefellows/mirror/filesystem/utils"
@@ -14,10 +17,19 @@ import (
 
 // Basic File System implementation using OOTB Golang constructs
 type StdFileSystem struct {
-	tree    filesystem.FileTree // Returns a FileTree structure of Files representing the FileSystem hierarchy
-	rootUrl neturl.URL
+	tree     filesystem.FileTree // Returns a FileTree structure of Files representing the FileSystem hierarchy
+	rootUrl  neturl.URL
+	Symlinks filesystem.SymlinkPolicy // How symbolic links are read. Links are preserved by default
+	Xattrs   bool                     // Read the extended attributes of each File
+	Root     string                   // If set, symlinks are only followed to Files inside it. See Within
 }
 
+// The SymlinkPolicy of StdFileSystems created by NewStdFileSystem
+var Symlinks = filesystem.SymlinkPreserve
+
+// Whether StdFileSystems created by NewStdFileSystem read extended attributes
+var Xattrs = false
+
 func init() {
 	mirror.FileSystemFactories.Register(NewStdFileSystem, "file")
 }
@@ -25,16 +37,36 @@ func init() {
 func NewStdFileSystem(path string) (filesystem.FileSystem, error) {
 	u, err := neturl.Parse(path)
 
-	return StdFileSystem{rootUrl: *u}, err
+	return StdFileSystem{rootUrl: *u, Symlinks: Symlinks, Xattrs: Xattrs}, err
 }
 
 func (fs StdFileSystem) Dir(dir string) ([]filesystem.File, error) {
 	readFiles, err := ioutil.ReadDir(utils.LinuxPath(fmt.Sprintf("%v/", dir)))
 	if err == nil {
-		files := make([]filesystem.File, len(readFiles))
+		files := make([]filesystem.File, 0, len(readFiles))
 
-		for i, file := range readFiles {
-			files[i] = FromFileInfo(dir, file)
+		for _, info := range readFiles {
+			if IsTempName(info.Name()) {
+				continue
+			}
+			if info.Mode()&os.ModeSymlink == 0 {
+				files = append(files, fs.fromFileInfo(dir, info))
+				continue
+			}
+			switch fs.Symlinks {
+			case filesystem.SymlinkSkip:
+			case filesystem.SymlinkFollow:
+				path := utils.LinuxPath(fmt.Sprintf("%s/%s", dir, info.Name()))
+				if err := fs.within(path); err != nil {
+					log.Printf("Skipping symlink %s: %v", path, err)
+				} else if target, err := os.Stat(path); err == nil {
+					files = append(files, fs.fromFileInfo(dir, target))
+				} else {
+					log.Printf("Skipping broken symlink %s: %v", path, err)
+				}
+			default:
+				files = append(files, fs.fromFileInfo(dir, info))
+			}
 		}
 
 		return files, nil
@@ -43,6 +75,36 @@ func (fs StdFileSystem) Dir(dir string) ([]filesystem.File, error) {
 	}
 }
 
+// Whether name is one of the files mirror writes alongside a File while
+// transferring it: the temporary file of an AtomicWriter (.NAME.mirror-123),
+// a partial File kept for resuming (.NAME.mirror-partial), or a link being
+// put in place (.NAME.mirror-link). They are left out of listings, so that
+// they are neither synced nor deleted.
+func IsTempName(name string) bool {
+	i := strings.LastIndex(name, ".mirror-")
+	if !strings.HasPrefix(name, ".") || i < 2 {
+		return false
+	}
+	suffix := name[i+len(".mirror-"):]
+	if suffix == "partial" || suffix == "link" {
+		return true
+	}
+	for _, c := range suffix {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return suffix != ""
+}
+
+// Checks that a symlink leads somewhere inside the Root, if there is one
+func (fs StdFileSystem) within(path string) error {
+	if fs.Root == "" {
+		return nil
+	}
+	return Within(fs.Root, path, true)
+}
+
 // Converts a FileInfo -> StdFile
 func FromFileInfo(dir string, i os.FileInfo) filesystem.File {
 
@@ -54,6 +116,24 @@ func FromFileInfo(dir string, i os.FileInfo) filesystem.File {
 		FileSize:    i.Size(),
 		FileModTime: i.ModTime(),
 	}
+	statFile(&file, i)
+	if file.IsSymlink() {
+		file.FileLink, _ = os.Readlink(path)
+	}
+	return file
+}
+
+// FromFileInfo, along with the extended attributes of the File if they
+// are being read. The attributes of a link are not read, as the link
+// cannot be opened without following it.
+func (fs StdFileSystem) fromFileInfo(dir string, i os.FileInfo) filesystem.File {
+	file := FromFileInfo(dir, i)
+	if fs.Xattrs && !file.IsSymlink() {
+		var err error
+		if file.FileXattrs, err = getXattrs(file.Path()); err != nil {
+			log.Printf("Unable to read extended attributes of %s: %v\n", file.Path(), err)
+		}
+	}
 	return file
 }
 
@@ -61,13 +141,23 @@ func (fs StdFileSystem) Read(f filesystem.File) ([]byte, error) {
 	return ioutil.ReadFile(f.Path())
 }
 
+func (fs StdFileSystem) Open(f filesystem.File) (io.ReadCloser, error) {
+	return os.Open(f.Path())
+}
+
+// A symbolic link is read as a link, unless the SymlinkPolicy is to follow it
 func (fs StdFileSystem) ReadFile(f string) (filesystem.File, error) {
-	i, err := os.Stat(f)
+	i, err := os.Lstat(f)
+	if err == nil && i.Mode()&os.ModeSymlink != 0 && fs.Symlinks == filesystem.SymlinkFollow {
+		if err = fs.within(f); err == nil {
+			i, err = os.Stat(f)
+		}
+	}
 	parentPath := filepath.Dir(f)
 	if err != nil {
 		return filesystem.File{}, err
 	}
-	return FromFileInfo(parentPath, i), err
+	return fs.fromFileInfo(parentPath, i), err
 }
 
 func (fs StdFileSystem) Delete(file string) error {
@@ -75,6 +165,97 @@ func (fs StdFileSystem) Delete(file string) error {
 }
 
 func (fs StdFileSystem) Write(file filesystem.File, data []byte, perm os.FileMode) error {
+	fs.mkParentDir(file)
+	w, err := NewAtomicWriter(file, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// The File is only replaced once it has been completely written. See AtomicWriter.
+func (fs StdFileSystem) Create(file filesystem.File, perm os.FileMode) (io.WriteCloser, error) {
+	fs.mkParentDir(file)
+	return NewAtomicWriter(file, perm)
+}
+
+// Remove a symbolic link that is about to be replaced, so that the File
+// is written in its place rather than to whatever it points to
+func removeSymlink(file filesystem.File) {
+	if i, err := os.Lstat(file.Path()); err == nil && i.Mode()&os.ModeSymlink != 0 {
+		os.Remove(file.Path())
+	}
+}
+
+// Give a newly written file at path the permissions it was written with,
+// which are otherwise masked by the umask, and the extended attributes and
+// modification time of the File it is a copy of.
+func setAttributes(path string, file filesystem.File, perm os.FileMode) error {
+	if err := os.Chmod(path, perm); err != nil {
+		return err
+	}
+	if file.FileXattrs != nil {
+		if err := setXattrs(path, file.FileXattrs); err != nil {
+			return err
+		}
+	}
+	if file.ModTime().IsZero() {
+		return nil
+	}
+	return os.Chtimes(path, file.ModTime(), file.ModTime())
+}
+
+// Writes a File to a hidden temporary file in the same directory, which is
+// synced to disk and renamed over the File on Close. Until then, the File
+// is left as it was, so a reader never sees it partly written, and an
+// interrupted transfer never leaves a truncated File behind.
+type AtomicWriter struct {
+	*os.File // The temporary file
+	file     filesystem.File
+	perm     os.FileMode
+}
+
+func NewAtomicWriter(file filesystem.File, perm os.FileMode) (*AtomicWriter, error) {
+	dir, name := filepath.Split(file.Path())
+	tmp, err := ioutil.TempFile(dir, fmt.Sprintf(".%s.mirror-", name))
+	if err != nil {
+		return nil, err
+	}
+	return &AtomicWriter{File: tmp, file: file, perm: perm}, nil
+}
+
+// Close moves the temporary file into place, once it is on disk and has the
+// attributes of the File. Writing to it would otherwise update its
+// modification time.
+func (w *AtomicWriter) Close() error {
+	err := w.File.Sync()
+	if cerr := w.File.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = setAttributes(w.Name(), w.file, w.perm)
+	}
+	if err == nil {
+		err = os.Rename(w.Name(), w.file.Path())
+	}
+	if err != nil {
+		os.Remove(w.Name())
+	}
+	return err
+}
+
+// Abort discards the temporary file, leaving the File untouched
+func (w *AtomicWriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.Name())
+}
+
+// Ensure the parent directory of a File exists before writing to it
+func (fs StdFileSystem) mkParentDir(file filesystem.File) {
 	parentPath := filepath.Dir(file.Path())
 	if _, err := os.Stat(parentPath); err != nil {
 		dir := filesystem.File{
@@ -83,22 +264,84 @@ func (fs StdFileSystem) Write(file filesystem.File, data []byte, perm os.FileMod
 		}
 		fs.MkDir(dir)
 	}
-	return ioutil.WriteFile(file.Path(), data, perm)
 }
 
 func (fs StdFileSystem) MkDir(file filesystem.File) error {
+	removeSymlink(file)
 	return os.MkdirAll(file.Path(), file.Mode())
 }
 
-func (fs StdFileSystem) FileMap(file filesystem.File) filesystem.FileMap {
+// The link is made under a temporary name and then moved into place, so
+// that a File being replaced is never missing
+func (fs StdFileSystem) Link(file filesystem.File, existing filesystem.File) error {
+	fs.mkParentDir(file)
+	tmp := filepath.Join(filepath.Dir(file.Path()), fmt.Sprintf(".%s.mirror-link", file.Name()))
+	os.Remove(tmp)
+	if err := os.Link(existing.Path(), tmp); err != nil {
+		return err
+	}
+	err := os.Rename(tmp, file.Path())
+	// Renaming over a link to the same inode does nothing, leaving tmp behind
+	os.Remove(tmp)
+	return err
+}
+
+func (fs StdFileSystem) Mknod(file filesystem.File) error {
+	fs.mkParentDir(file)
+	if i, err := os.Lstat(file.Path()); err == nil {
+		if i.IsDir() {
+			return fmt.Errorf("Cannot replace directory %s with a special file", file.Path())
+		}
+		if err = os.Remove(file.Path()); err != nil {
+			return err
+		}
+	}
+	if err := mknod(file); err != nil {
+		return err
+	}
+	return setAttributes(file.Path(), file, file.Mode().Perm())
+}
+
+func (fs StdFileSystem) Symlink(file filesystem.File, target string) error {
+	fs.mkParentDir(file)
+	if i, err := os.Lstat(file.Path()); err == nil {
+		if i.IsDir() {
+			return fmt.Errorf("Cannot replace directory %s with a symlink", file.Path())
+		}
+		if err = os.Remove(file.Path()); err != nil {
+			return err
+		}
+	}
+	return os.Symlink(target, file.Path())
+}
+
+func (fs StdFileSystem) Chmod(file filesystem.File, perm os.FileMode) error {
+	return os.Chmod(file.Path(), perm)
+}
+
+func (fs StdFileSystem) SetXattrs(file filesystem.File, attrs filesystem.Xattrs) error {
+	return setXattrs(file.Path(), attrs)
+}
+
+// Lchown, so that a symlink is given the owner rather than its target
+func (fs StdFileSystem) Chown(file filesystem.File, owner int, group int) error {
+	return os.Lchown(file.Path(), owner, group)
+}
+
+// A directory that can not be listed fails the whole FileMap, rather than
+// appearing to be empty
+func (fs StdFileSystem) FileMap(file filesystem.File) (filesystem.FileMap, error) {
 	if !file.IsDir() {
-		return nil
+		return nil, nil
 	}
 	tree := &filesystem.FileTree{}
-
 	tree.StdFile = file
-	fileMap, _ := filesystem.FileTreeToMap(*fs.FileTree(file), file.Path())
-	return fileMap
+	var err error
+	tree = fs.readDir(file, tree, nil, &err)
+	if err != nil {
+		return nil, err
+	}
+	return filesystem.FileTreeToMap(*tree, file.Path())
 }
 
 func (fs StdFileSystem) FileTree(file filesystem.File) *filesystem.FileTree {
@@ -107,24 +350,39 @@ func (fs StdFileSystem) FileTree(file filesystem.File) *filesystem.FileTree {
 	}
 	tree := &filesystem.FileTree{}
 	tree.StdFile = file
-	return fs.readDir(file, tree)
+	var err error
+	return fs.readDir(file, tree, nil, &err)
 }
 
-// Recursively read a directory structure and create a tree structure out of it
-// TODO: fix symlinks/cyclic dependencies etc.
-func (fs StdFileSystem) readDir(curFile filesystem.File, parent *filesystem.FileTree) *filesystem.FileTree {
+// Recursively read a directory structure and create a tree structure out of it.
+//
+// When following symlinks, a link back to one of the directories being read
+// would recurse forever, so a directory already in ancestors is left out.
+// The first directory that can not be listed is recorded in err.
+func (fs StdFileSystem) readDir(curFile filesystem.File, parent *filesystem.FileTree, ancestors []os.FileInfo, err *error) *filesystem.FileTree {
 	tree := &filesystem.FileTree{}
 	tree.StdFile = curFile
 	tree.StdParentNode = parent
 
-	// TODO: Symlink check not working...
-	if curFile.IsDir() || curFile.Mode() == os.ModeSymlink {
+	if curFile.IsDir() {
+		if info, err := os.Stat(curFile.Path()); err == nil {
+			for _, ancestor := range ancestors {
+				if os.SameFile(ancestor, info) {
+					log.Printf("Skipping %s, which links back to a parent directory\n", curFile.Path())
+					return nil
+				}
+			}
+			ancestors = append(ancestors, info)
+		}
 
 		tree.StdChildNodes = make([]*filesystem.FileTree, 0)
-		dirListing, _ := fs.Dir(curFile.Path())
-		if dirListing != nil && len(dirListing) > 0 {
-			for _, file := range dirListing {
-				tree.StdChildNodes = append(tree.StdChildNodes, fs.readDir(file, tree))
+		dirListing, dirErr := fs.Dir(curFile.Path())
+		if dirErr != nil && *err == nil {
+			*err = dirErr
+		}
+		for _, file := range dirListing {
+			if child := fs.readDir(file, tree, ancestors, err); child != nil {
+				tree.StdChildNodes = append(tree.StdChildNodes, child)
 			}
 		}
 	}
@@ -3,8 +3,13 @@ package fs
 import (
 	"github.com/mefellows/mirror/filesystem"
 	mirror "github.com/mefellows/mirror/mirror"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
 )
 
 func TestStdFileSystem(t *testing.T) {
@@ -49,3 +54,259 @@ func TestLookupFilesystemFactory(t *testing.T) {
 	}
 
 }
+
+func TestOpenCreate(t *testing.T) {
+	fs := StdFileSystem{}
+	dir, _ := ioutil.TempDir("", "mirror-fs-test")
+	defer os.RemoveAll(dir)
+
+	file := filesystem.File{FileName: "bar.txt", FilePath: filepath.Join(dir, "foo", "bar.txt")}
+	w, err := fs.Create(file, 0644)
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	io.WriteString(w, "hello\ngo\n")
+	if err = w.Close(); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+
+	r, err := fs.Open(file)
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	defer r.Close()
+	data, _ := ioutil.ReadAll(r)
+	if string(data) != "hello\ngo\n" {
+		t.Fatalf("Expected to read back 'hello\\ngo\\n', got %s", data)
+	}
+}
+
+func TestDir_TempFiles(t *testing.T) {
+	fs := StdFileSystem{}
+	dir, _ := ioutil.TempDir("", "mirror-fs-test")
+	defer os.RemoveAll(dir)
+
+	file := filesystem.File{FileName: "big.bin", FilePath: filepath.Join(dir, "big.bin")}
+	w, err := NewAtomicWriter(file, 0644)
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	defer w.Abort()
+	ioutil.WriteFile(PartialPath(file), []byte("part"), 0644)
+	for _, name := range []string{"keep.txt", ".keep.mirror-notes", ".mirror-123"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+	}
+
+	files, err := fs.Dir(dir)
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if len(names) != 3 || names[0] != ".keep.mirror-notes" || names[1] != ".mirror-123" || names[2] != "keep.txt" {
+		t.Fatalf("Expected the temporary and partial files to be left out, got %v", names)
+	}
+
+	root, _ := fs.ReadFile(dir)
+	if fileMap, _ := fs.FileMap(root); len(fileMap) != 3 {
+		t.Fatalf("Expected the temporary and partial files to be left out of the FileMap, got %v", fileMap)
+	}
+}
+
+func TestCreate_Atomic(t *testing.T) {
+	fs := StdFileSystem{}
+	dir, _ := ioutil.TempDir("", "mirror-fs-test")
+	defer os.RemoveAll(dir)
+
+	file := filesystem.File{FileName: "atomic.txt", FilePath: filepath.Join(dir, "atomic.txt")}
+	ioutil.WriteFile(file.Path(), []byte("original"), 0644)
+
+	w, err := fs.Create(file, 0644)
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	io.WriteString(w, "partial")
+	if data, _ := ioutil.ReadFile(file.Path()); string(data) != "original" {
+		t.Fatalf("Expected file to be untouched until closed, got %s", data)
+	}
+	w.(filesystem.AbortWriter).Abort()
+
+	if data, _ := ioutil.ReadFile(file.Path()); string(data) != "original" {
+		t.Fatalf("Expected aborted write to leave the file untouched, got %s", data)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("Expected temporary files to be removed, found %d files", len(files))
+	}
+
+	if err = fs.Write(file, []byte("replaced"), 0644); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(file.Path()); string(data) != "replaced" {
+		t.Fatalf("Expected file to be replaced, got %s", data)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("Expected temporary files to be removed, found %d files", len(files))
+	}
+}
+
+func TestWriteCreate_Attributes(t *testing.T) {
+	fs := StdFileSystem{}
+	dir, _ := ioutil.TempDir("", "mirror-fs-test")
+	defer os.RemoveAll(dir)
+
+	modTime := time.Date(2015, time.March, 1, 12, 0, 0, 0, time.UTC)
+	written := filesystem.File{FileName: "written.txt", FilePath: filepath.Join(dir, "written.txt"), FileModTime: modTime}
+	if err := fs.Write(written, []byte("hello"), 0600); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+
+	created := filesystem.File{FileName: "created.sh", FilePath: filepath.Join(dir, "created.sh"), FileModTime: modTime}
+	w, err := fs.Create(created, 0755)
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	io.WriteString(w, "#!/bin/sh\n")
+	if err = w.Close(); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+
+	for _, e := range []struct {
+		file filesystem.File
+		perm os.FileMode
+	}{{written, 0600}, {created, 0755}} {
+		file, err := fs.ReadFile(e.file.Path())
+		if err != nil {
+			t.Fatalf("Did not expect err: %v", err)
+		}
+		if file.Mode().Perm() != e.perm {
+			t.Fatalf("Expected %s to have permissions %s, got %s", file.Name(), e.perm, file.Mode().Perm())
+		}
+		if !file.ModTime().Equal(modTime) {
+			t.Fatalf("Expected %s to have modification time %v, got %v", file.Name(), modTime, file.ModTime())
+		}
+		if runtime.GOOS != "windows" && (!file.HasOwner || file.Owner() != os.Getuid()) {
+			t.Fatalf("Expected %s to be owned by %d, got %d", file.Name(), os.Getuid(), file.Owner())
+		}
+	}
+}
+
+func TestFileTree_Symlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Symlinks require privileges on Windows")
+	}
+	dir, _ := ioutil.TempDir("", "mirror-fs-test")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "file.txt"), []byte("hello"), 0644)
+	os.Symlink("file.txt", filepath.Join(dir, "sub", "link.txt"))
+	os.Symlink("missing.txt", filepath.Join(dir, "sub", "broken.txt"))
+	// A loop back to the root
+	os.Symlink("..", filepath.Join(dir, "sub", "loop"))
+
+	tests := []struct {
+		policy   filesystem.SymlinkPolicy
+		expected []string
+	}{
+		{filesystem.SymlinkPreserve, []string{"/sub", "/sub/broken.txt", "/sub/file.txt", "/sub/link.txt", "/sub/loop"}},
+		{filesystem.SymlinkFollow, []string{"/sub", "/sub/file.txt", "/sub/link.txt"}},
+		{filesystem.SymlinkSkip, []string{"/sub", "/sub/file.txt"}},
+	}
+	for _, test := range tests {
+		fs := StdFileSystem{Symlinks: test.policy}
+		root, err := fs.ReadFile(dir)
+		if err != nil {
+			t.Fatalf("Did not expect err: %v", err)
+		}
+		m, err := fs.FileMap(root)
+		if err != nil {
+			t.Fatalf("Did not expect err: %v", err)
+		}
+		if len(m) != len(test.expected) {
+			t.Fatalf("Expected %s to read %v, got %v", test.policy, test.expected, m)
+		}
+		for _, path := range test.expected {
+			if _, ok := m[path]; !ok {
+				t.Fatalf("Expected %s to read %s, got %v", test.policy, path, m)
+			}
+		}
+
+		link := m["/sub/link.txt"]
+		switch test.policy {
+		case filesystem.SymlinkPreserve:
+			if !link.IsSymlink() || link.LinkTarget() != "file.txt" {
+				t.Fatalf("Expected link.txt to be a link to file.txt, got %v", link)
+			}
+		case filesystem.SymlinkFollow:
+			if link.IsSymlink() || link.Size() != 5 {
+				t.Fatalf("Expected link.txt to be read as file.txt, got %v", link)
+			}
+		}
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Symlinks require privileges on Windows")
+	}
+	fs := StdFileSystem{}
+	dir, _ := ioutil.TempDir("", "mirror-fs-test")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "target.txt"), []byte("target"), 0644)
+
+	link := filesystem.File{FileName: "link.txt", FilePath: filepath.Join(dir, "link.txt")}
+	if err := fs.Symlink(link, "target.txt"); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	// Replacing the link must not write through it to the target
+	if err := fs.Write(link, []byte("replaced"), 0644); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "target.txt")); string(data) != "target" {
+		t.Fatalf("Expected target.txt to be untouched, got %s", data)
+	}
+	if file, _ := fs.ReadFile(link.Path()); file.IsSymlink() {
+		t.Fatalf("Expected link.txt to be replaced by a file")
+	}
+}
+
+func TestLinkMknod(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("No FIFOs on Windows")
+	}
+	fs := StdFileSystem{}
+	dir, _ := ioutil.TempDir("", "mirror-fs-test")
+	defer os.RemoveAll(dir)
+
+	fifo := filesystem.File{FileName: "fifo", FilePath: filepath.Join(dir, "fifo"), FileMode: os.ModeNamedPipe | 0640}
+	if err := fs.Mknod(fifo); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	file, err := fs.ReadFile(fifo.Path())
+	if err != nil || !file.IsSpecial() || file.Mode() != os.ModeNamedPipe|0640 {
+		t.Fatalf("Expected a FIFO, got %v: %v", file.Mode(), err)
+	}
+
+	original := filesystem.File{FileName: "original.txt", FilePath: filepath.Join(dir, "original.txt")}
+	fs.Write(original, []byte("shared"), 0644)
+	link := filesystem.File{FileName: "link.txt", FilePath: filepath.Join(dir, "link.txt")}
+	fs.Write(link, []byte("separate"), 0644)
+	if err := fs.Link(link, original); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	// Linking again is harmless
+	if err := fs.Link(link, original); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+
+	dirListing, _ := fs.Dir(dir)
+	if len(dirListing) != 3 {
+		t.Fatalf("Expected only fifo, link.txt and original.txt, got %v", dirListing)
+	}
+	a, _ := fs.ReadFile(original.Path())
+	b, _ := fs.ReadFile(link.Path())
+	if !a.IsHardLink() || a.FileNlink != 2 || a.FileInode != b.FileInode {
+		t.Fatalf("Expected link.txt and original.txt to share an inode, got %d and %d", a.FileInode, b.FileInode)
+	}
+}
@@ -0,0 +1,42 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/mefellows/mirror/filesystem"
+)
+
+// Fill in the ownership and identity of a File, which are only available
+// from the underlying stat
+func statFile(file *filesystem.File, i os.FileInfo) {
+	if stat, ok := i.Sys().(*syscall.Stat_t); ok {
+		file.FileOwner, file.FileGroup, file.HasOwner = int(stat.Uid), int(stat.Gid), true
+		file.FileDev = uint64(stat.Dev)
+		file.FileInode = uint64(stat.Ino)
+		file.FileNlink = uint64(stat.Nlink)
+		file.FileRdev = uint64(stat.Rdev)
+	}
+}
+
+func mknod(file filesystem.File) error {
+	var kind uint32
+	mode := file.Mode()
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		kind = syscall.S_IFIFO
+	case mode&os.ModeSocket != 0:
+		kind = syscall.S_IFSOCK
+	case mode&os.ModeCharDevice != 0:
+		kind = syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		kind = syscall.S_IFBLK
+	default:
+		return fmt.Errorf("%s is not a special file", file.Path())
+	}
+	return sysMknod(file.Path(), kind|uint32(mode.Perm()), file.FileRdev)
+}
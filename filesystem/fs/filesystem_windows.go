@@ -0,0 +1,16 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mefellows/mirror/filesystem"
+)
+
+// Windows has no numeric owners or inodes, so they are never reported
+func statFile(file *filesystem.File, i os.FileInfo) {
+}
+
+func mknod(file filesystem.File) error {
+	return fmt.Errorf("Special files cannot be created on Windows: %s", file.Path())
+}
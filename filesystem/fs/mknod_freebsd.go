@@ -0,0 +1,8 @@
+package fs
+
+import "syscall"
+
+// FreeBSD takes the device number as it is reported by stat
+func sysMknod(path string, mode uint32, rdev uint64) error {
+	return syscall.Mknod(path, mode, rdev)
+}
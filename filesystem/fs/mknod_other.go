@@ -0,0 +1,10 @@
+//go:build !windows && !freebsd
+// +build !windows,!freebsd
+
+package fs
+
+import "syscall"
+
+func sysMknod(path string, mode uint32, rdev uint64) error {
+	return syscall.Mknod(path, mode, int(rdev))
+}
@@ -0,0 +1,85 @@
+package fs
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mefellows/mirror/filesystem"
+	"github.com/mefellows/mirror/filesystem/delta"
+)
+
+// Where a File is written to while its transfer is resumable. Unlike the
+// temporary files of an AtomicWriter, this is found again by the next
+// transfer of the same File.
+func PartialPath(file filesystem.File) string {
+	dir, name := filepath.Split(file.Path())
+	return filepath.Join(dir, fmt.Sprintf(".%s.mirror-partial", name))
+}
+
+func (fs StdFileSystem) PartialSignature(file filesystem.File, blockSize int) (*delta.Signature, error) {
+	f, err := os.Open(PartialPath(file))
+	if os.IsNotExist(err) {
+		return &delta.Signature{BlockSize: blockSize, Blocks: make([]delta.BlockSignature, 0)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return delta.NewSignature(f, blockSize)
+}
+
+// Only the part of the partial File kept from an earlier transfer is read
+// back to be hashed; the rest is hashed as it is written.
+func (fs StdFileSystem) Resume(file filesystem.File, perm os.FileMode, offset int64, algorithm string) (filesystem.ResumeWriter, error) {
+	h, err := filesystem.NewHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	fs.mkParentDir(file)
+	f, err := os.OpenFile(PartialPath(file), os.O_RDWR|os.O_CREATE, 0600)
+	if err == nil {
+		err = f.Truncate(offset)
+	}
+	if err == nil {
+		// Leaves the File at offset, ready for the rest
+		_, err = io.CopyN(h, f, offset)
+	}
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return nil, err
+	}
+	return &resumeWriter{out: &AtomicWriter{File: f, file: file, perm: perm}, hash: h}, nil
+}
+
+// Writes to the partial File, which is moved into place like any other
+// AtomicWriter once the whole File has been checked. The AtomicWriter is
+// not embedded, so that nothing can be written to it without being hashed.
+type resumeWriter struct {
+	out  *AtomicWriter
+	hash hash.Hash // Of everything in the partial File so far
+}
+
+func (w *resumeWriter) Write(p []byte) (int, error) {
+	n, err := w.out.Write(p)
+	w.hash.Write(p[:n])
+	return n, err
+}
+
+func (w *resumeWriter) Commit(sum string) error {
+	if actual := hex.EncodeToString(w.hash.Sum(nil)); actual != sum {
+		w.out.Abort()
+		return fmt.Errorf("Checksum of %s is %s, expected %s. The partial file has been discarded", w.out.file.Path(), actual, sum)
+	}
+	return w.out.Close()
+}
+
+// Abort keeps the partial File, unlike that of an AtomicWriter
+func (w *resumeWriter) Abort() error {
+	return w.out.File.Close()
+}
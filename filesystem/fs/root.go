@@ -0,0 +1,94 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The number of symlinks followed in resolving a path before giving up
+const maxSymlinks = 255
+
+// Checks that path is inside root, which must be absolute and free of
+// symlinks, once every symlink along the way is followed. If follow is
+// false, a symlink at path itself is not followed, as for an operation on
+// the link rather than what it points to.
+//
+// Paths that do not exist yet are resolved as far as they do.
+func Within(root string, path string, follow bool) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("Access denied: %s is not an absolute path", path)
+	}
+	for _, part := range strings.Split(filepath.ToSlash(path), "/") {
+		if part == ".." {
+			return fmt.Errorf("Access denied: %s may not contain '..'", path)
+		}
+	}
+
+	path = filepath.Clean(path)
+	resolved, err := resolve(filepath.Dir(path), 0)
+	if err != nil {
+		return err
+	}
+	resolved = filepath.Join(resolved, filepath.Base(path))
+	if follow {
+		if resolved, err = resolve(resolved, 0); err != nil {
+			return err
+		}
+	}
+
+	if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("Access denied: %s is outside of %s", path, root)
+	}
+	return nil
+}
+
+// Follow every symlink in path, including any at the end of it, for as much
+// of the path as exists. Unlike filepath.EvalSymlinks, a link to something
+// that does not exist yet is followed too, as creating it would be.
+func resolve(path string, links int) (string, error) {
+	if links > maxSymlinks {
+		return "", fmt.Errorf("Too many levels of symbolic links in %s", path)
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err == nil || !os.IsNotExist(err) {
+		return real, err
+	}
+
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path, nil
+	}
+	realParent, err := resolve(parent, links)
+	if err != nil {
+		return "", err
+	}
+	path = filepath.Join(realParent, filepath.Base(path))
+	target, err := os.Readlink(path)
+	if err != nil {
+		return path, nil
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(realParent, target)
+	}
+	return resolve(target, links+1)
+}
+
+// The absolute path of a directory, with any symlinks resolved, for use as
+// the root given to Within
+func RootPath(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if abs, err = filepath.EvalSymlinks(abs); err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(abs); err != nil {
+		return "", err
+	} else if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	return abs, nil
+}
@@ -0,0 +1,68 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/mefellows/mirror/filesystem"
+)
+
+func TestWithin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Symlinks require privileges on Windows")
+	}
+	dir, _ := ioutil.TempDir("", "mirror-fs-test")
+	defer os.RemoveAll(dir)
+	root, err := RootPath(filepath.Join(dir, "root"))
+	if err == nil {
+		t.Fatalf("Expected a missing root to be rejected")
+	}
+	os.MkdirAll(filepath.Join(dir, "root", "sub"), 0755)
+	os.Mkdir(filepath.Join(dir, "outside"), 0755)
+	if root, err = RootPath(filepath.Join(dir, "root")); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+
+	os.Symlink(filepath.Join(dir, "outside"), filepath.Join(root, "escape"))
+	os.Symlink("sub", filepath.Join(root, "inside"))
+	os.Symlink(filepath.Join(dir, "outside", "new.txt"), filepath.Join(root, "dangling"))
+
+	for _, e := range []struct {
+		path   string
+		follow bool
+		ok     bool
+	}{
+		{root, true, true},
+		{filepath.Join(root, "sub", "new", "file.txt"), true, true},
+		{filepath.Join(root, "inside", "file.txt"), true, true},
+		{root + "/sub/../sub", true, false},
+		{filepath.Join(dir, "outside"), true, false},
+		{"relative/path", true, false},
+		{filepath.Join(root, "escape", "file.txt"), true, false},
+		{filepath.Join(root, "escape", "file.txt"), false, false},
+		{filepath.Join(root, "escape"), true, false},
+		{filepath.Join(root, "escape"), false, true},
+		{filepath.Join(root, "dangling"), true, false},
+		{filepath.Join(root, "dangling"), false, true},
+	} {
+		if err := Within(root, e.path, e.follow); (err == nil) != e.ok {
+			t.Fatalf("Expected Within(%s, follow: %v) to be %v, got %v", e.path, e.follow, e.ok, err)
+		}
+	}
+
+	// Symlinks that lead out of the root are not followed
+	ioutil.WriteFile(filepath.Join(dir, "outside", "secret.txt"), []byte("secret"), 0644)
+	fs := StdFileSystem{Symlinks: filesystem.SymlinkFollow, Root: root}
+	files, _ := fs.Dir(root)
+	for _, file := range files {
+		if file.Name() == "escape" || file.Name() == "dangling" {
+			t.Fatalf("Expected %s to be skipped", file.Name())
+		}
+	}
+	if _, err = fs.ReadFile(filepath.Join(root, "escape")); err == nil {
+		t.Fatalf("Expected a symlink out of the root not to be followed")
+	}
+}
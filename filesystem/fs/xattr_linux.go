@@ -0,0 +1,84 @@
+package fs
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"syscall"
+
+	"github.com/mefellows/mirror/filesystem"
+)
+
+// Read every extended attribute of a file, which includes its POSIX ACLs.
+// A file system without extended attributes has none.
+func getXattrs(path string) (filesystem.Xattrs, error) {
+	attrs := make(filesystem.Xattrs)
+	size, err := syscall.Listxattr(path, nil)
+	if err == syscall.ENOTSUP {
+		return attrs, nil
+	}
+	if err != nil || size == 0 {
+		return attrs, err
+	}
+	names := make([]byte, size)
+	if size, err = syscall.Listxattr(path, names); err != nil {
+		return nil, err
+	}
+
+	for _, name := range strings.Split(string(names[:size]), "\x00") {
+		if name == "" {
+			continue
+		}
+		size, err := syscall.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		if size, err = syscall.Getxattr(path, name, value); err != nil {
+			return nil, err
+		}
+		attrs[name] = value[:size]
+	}
+	return attrs, nil
+}
+
+// Make the extended attributes of a file match attrs, removing any others
+// that are synced. Attributes the file system does not support, or that
+// need privileges the process lacks, are skipped.
+func setXattrs(path string, attrs filesystem.Xattrs) error {
+	current, err := getXattrs(path)
+	if err != nil {
+		return err
+	}
+	for name := range current {
+		if _, keep := attrs[name]; !keep && syncedXattr(name) {
+			if err = skipXattrError(path, name, syscall.Removexattr(path, name)); err != nil {
+				return err
+			}
+		}
+	}
+	for name, value := range attrs {
+		if old, ok := current[name]; !ok || !bytes.Equal(old, value) {
+			if err = skipXattrError(path, name, syscall.Setxattr(path, name, value, 0)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Whether an attribute missing from the source is removed from the
+// destination. Others, such as security.selinux, belong to the system the
+// file is on, and are left alone.
+func syncedXattr(name string) bool {
+	return strings.HasPrefix(name, "user.") || strings.HasPrefix(name, "trusted.") ||
+		strings.HasPrefix(name, "system.posix_acl_") || name == "security.capability"
+}
+
+func skipXattrError(path string, name string, err error) error {
+	if err == syscall.ENOTSUP || err == syscall.EPERM {
+		log.Printf("Skipping extended attribute %s of %s: %v\n", name, path, err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/mefellows/mirror/filesystem"
+)
+
+func TestXattrs(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "mirror-fs-test")
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src.txt")
+	ioutil.WriteFile(src, []byte("src"), 0644)
+	if err := syscall.Setxattr(src, "user.mirror", []byte("test"), 0); err != nil {
+		t.Skipf("Extended attributes are not supported in %s: %v", dir, err)
+	}
+
+	fs := StdFileSystem{Xattrs: true}
+	file, err := fs.ReadFile(src)
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if string(file.FileXattrs["user.mirror"]) != "test" {
+		t.Fatalf("Expected user.mirror to be read, got %v", file.FileXattrs)
+	}
+
+	// Restored when written, replacing any attributes already there
+	dest := filesystem.File{FileName: "dest.txt", FilePath: filepath.Join(dir, "dest.txt"), FileXattrs: file.FileXattrs}
+	ioutil.WriteFile(dest.Path(), []byte("old"), 0644)
+	syscall.Setxattr(dest.Path(), "user.stale", []byte("stale"), 0)
+	if err = fs.Write(dest, []byte("src"), 0644); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	written, _ := fs.ReadFile(dest.Path())
+	if !written.FileXattrs.Equal(file.FileXattrs) {
+		t.Fatalf("Expected %v, got %v", file.FileXattrs, written.FileXattrs)
+	}
+
+	if err = fs.SetXattrs(dest, filesystem.Xattrs{}); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if cleared, _ := fs.ReadFile(dest.Path()); cleared.FileXattrs["user.mirror"] != nil {
+		t.Fatalf("Expected every attribute to be removed, got %v", cleared.FileXattrs)
+	}
+
+	// Attributes that can not be set are skipped
+	attrs := filesystem.Xattrs{"user.mirror": []byte("test"), "unsupported.mirror": []byte("test")}
+	if err = fs.SetXattrs(dest, attrs); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if skipped, _ := fs.ReadFile(dest.Path()); string(skipped.FileXattrs["user.mirror"]) != "test" {
+		t.Fatalf("Expected user.mirror to be set, got %v", skipped.FileXattrs)
+	}
+
+	// Attributes that are not synced, such as SELinux labels, are kept
+	if err = syscall.Setxattr(dest.Path(), "security.mirror", []byte("label"), 0); err == nil {
+		fs.SetXattrs(dest, filesystem.Xattrs{})
+		if kept, _ := fs.ReadFile(dest.Path()); string(kept.FileXattrs["security.mirror"]) != "label" {
+			t.Fatalf("Expected security.mirror to be kept, got %v", kept.FileXattrs)
+		}
+	}
+
+	// Not read unless asked for
+	if unread, _ := (StdFileSystem{}).ReadFile(src); unread.FileXattrs != nil {
+		t.Fatalf("Expected attributes not to be read")
+	}
+}
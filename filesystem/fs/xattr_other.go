@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package fs
+
+import (
+	"fmt"
+
+	"github.com/mefellows/mirror/filesystem"
+)
+
+// Extended attributes are only supported on Linux, so none are reported
+func getXattrs(path string) (filesystem.Xattrs, error) {
+	return nil, nil
+}
+
+func setXattrs(path string, attrs filesystem.Xattrs) error {
+	if len(attrs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Extended attributes are not supported on this platform: %s", path)
+}
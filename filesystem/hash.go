@@ -0,0 +1,59 @@
+package filesystem
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// Supported hash algorithms
+const (
+	SHA256 = "sha256"
+	MD5    = "md5"
+)
+
+// A FileSystem that can calculate the hash of a File more cheaply than
+// by streaming its contents to the client, e.g. by computing it
+// server-side, or from metadata it already holds.
+type HashFileSystem interface {
+	Hash(file File, algorithm string) (string, error) // Hex encoded hash of the contents of a File
+}
+
+func NewHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case SHA256:
+		return sha256.New(), nil
+	case MD5:
+		return md5.New(), nil
+	}
+	return nil, fmt.Errorf("Unsupported hash algorithm: %s", algorithm)
+}
+
+// Calculate the hash of a File, using the FileSystem's own implementation
+// if it has one.
+func FileHash(fs FileSystem, file File, algorithm string) (string, error) {
+	if hfs, ok := fs.(HashFileSystem); ok {
+		return hfs.Hash(file, algorithm)
+	}
+	return StreamHash(fs, file, algorithm)
+}
+
+// Calculate the hash of a File by reading its contents
+func StreamHash(fs FileSystem, file File, algorithm string) (string, error) {
+	h, err := NewHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	r, err := fs.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	if _, err = io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,94 @@
+package remote
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The kinds of Access a client may be granted
+type Rights map[Access]bool
+
+// Parses a comma separated list of rights: read, write and delete. Both
+// read and write also allow listing, which a sync needs to compare Files.
+func ParseRights(list string) (Rights, error) {
+	rights := make(Rights)
+	for _, right := range strings.Split(list, ",") {
+		switch strings.TrimSpace(right) {
+		case "read":
+			rights[List] = true
+			rights[Read] = true
+		case "write":
+			rights[List] = true
+			rights[Write] = true
+		case "delete":
+			rights[Delete] = true
+		default:
+			return nil, fmt.Errorf("Unknown right '%s'. Available rights: read, write, delete", right)
+		}
+	}
+	return rights, nil
+}
+
+// The Rights of each client, by a name it is known by: the common name or
+// subject of its certificate, or one of its subject alternative names.
+// The Rights given to "*" apply to every client.
+type ACL map[string]Rights
+
+// The name that gives Rights to every client
+const Anyone = "*"
+
+// Reads an ACL file, in which each line gives a name and its rights, e.g.
+//
+//	# name                 rights
+//	backup.mydomain.com    read,write
+//	admin@mydomain.com     read,write,delete
+//	*                      read
+//
+// Blank lines, and anything after a #, are ignored.
+func LoadACL(path string) (ACL, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	acl := make(ACL)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a name and a list of rights", path, line)
+		}
+		rights, err := ParseRights(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if _, ok := acl[fields[0]]; ok {
+			return nil, fmt.Errorf("%s:%d: %s is listed more than once", path, line, fields[0])
+		}
+		acl[fields[0]] = rights
+	}
+	return acl, scanner.Err()
+}
+
+// Whether a client known by any of names has the right to access
+func (a ACL) allows(names []string, access Access) bool {
+	if a[Anyone][access] {
+		return true
+	}
+	for _, name := range names {
+		if a[name][access] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package remote
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"sync"
+)
+
+// The gob codec of net/rpc, which also keeps count of the calls in
+// progress, so that a connection can be closed as soon as it is idle
+type serverCodec struct {
+	conn   net.Conn
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+
+	mutex    sync.Mutex
+	calls    int  // Calls read, but not yet answered
+	draining bool // Whether to close the connection once there are no calls
+	closed   bool
+}
+
+func newServerCodec(conn net.Conn) *serverCodec {
+	buf := bufio.NewWriter(conn)
+	return &serverCodec{conn: conn, dec: gob.NewDecoder(conn), enc: gob.NewEncoder(buf), encBuf: buf}
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.draining {
+		return io.EOF
+	}
+	c.calls++
+	return nil
+}
+
+func (c *serverCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	defer c.answered()
+	if err := c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			log.Println("rpc: gob error encoding response:", err)
+			c.Close()
+		}
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			log.Println("rpc: gob error encoding body:", err)
+			c.Close()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *serverCodec) answered() {
+	c.mutex.Lock()
+	c.calls--
+	idle := c.draining && c.calls == 0
+	c.mutex.Unlock()
+	if idle {
+		c.Close()
+	}
+}
+
+// Stops reading calls, closing the connection once those in progress have
+// been answered
+func (c *serverCodec) drain() {
+	c.mutex.Lock()
+	c.draining = true
+	idle := c.calls == 0
+	c.mutex.Unlock()
+	if idle {
+		c.Close()
+	}
+}
+
+func (c *serverCodec) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.conn.Close()
+}
@@ -0,0 +1,301 @@
+package remote
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/mefellows/mirror/filesystem/fs"
+	"github.com/mefellows/mirror/pki"
+)
+
+// The configuration file of a daemon, in HCL, e.g.
+//
+//	listen = ["0.0.0.0:8123"]
+//
+//	tls {
+//	  cert    = "/etc/mirror/server-cert.pem"
+//	  key     = "/etc/mirror/server-key.pem"
+//	  ca_cert = "/etc/mirror/ca/ca.pem"
+//	}
+//
+//	export "backups" {
+//	  path  = "/srv/backups"
+//	  mode  = "wo"
+//	  allow = ["backup.mydomain.com"]
+//	}
+//
+//	client "admin@mydomain.com" {
+//	  rights = ["read", "write", "delete"]
+//	}
+//
+//	log {
+//	  file = "/var/log/mirror/daemon.log"
+//	}
+//
+//	limits {
+//	  max_connections = 32
+//	  idle_timeout    = "10m"
+//	}
+//
+//	hooks {
+//	  on_connect = "/usr/local/bin/mirror-check-client"
+//	}
+type DaemonConfig struct {
+	Listen   []string        `hcl:"listen"`
+	Insecure bool            `hcl:"insecure"`
+	TLS      *TLSConfig      `hcl:"tls"`
+	Root     string          `hcl:"root"`
+	Exports  []*ExportConfig `hcl:"export"`
+	ACLFile  string          `hcl:"acl_file"`
+	Clients  []*ClientConfig `hcl:"client"`
+	Log      *LogConfig      `hcl:"log"`
+	Limits   *LimitsConfig   `hcl:"limits"`
+	Hooks    *Hooks          `hcl:"hooks"`
+	path     string
+}
+
+// The certificate and key the daemon presents, and the CA that client
+// certificates must be signed by. Any other .pem or .crt files in the
+// directory of the CA certificate are trusted too.
+type TLSConfig struct {
+	Cert   string `hcl:"cert"`
+	Key    string `hcl:"key"`
+	CACert string `hcl:"ca_cert"`
+}
+
+type ExportConfig struct {
+	Name  string   `hcl:",key"`
+	Path  string   `hcl:"path"`
+	Mode  string   `hcl:"mode"`
+	Allow []string `hcl:"allow"`
+}
+
+// The rights of a client, as in an ACL file
+type ClientConfig struct {
+	Name   string   `hcl:",key"`
+	Rights []string `hcl:"rights"`
+}
+
+type LogConfig struct {
+	File string `hcl:"file"`
+}
+
+type LimitsConfig struct {
+	MaxConnections  int    `hcl:"max_connections"`
+	IdleTimeout     string `hcl:"idle_timeout"`
+	ShutdownTimeout string `hcl:"shutdown_timeout"`
+}
+
+// The address a daemon listens on, if none is configured
+const DefaultListen = ":8123"
+
+// The keys allowed in each part of a DaemonConfig
+var configKeys = map[string][]string{
+	"":       {"listen", "insecure", "tls", "root", "export", "acl_file", "client", "log", "limits", "hooks"},
+	"tls":    {"cert", "key", "ca_cert"},
+	"export": {"path", "mode", "allow"},
+	"client": {"rights"},
+	"log":    {"file"},
+	"limits": {"max_connections", "idle_timeout", "shutdown_timeout"},
+	"hooks":  {"on_connect", "on_disconnect"},
+}
+
+// Reads a DaemonConfig, checking its syntax but not its values. See Daemon
+func LoadDaemonConfig(path string) (*DaemonConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := hcl.ParseBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	root, ok := file.Node.(*ast.ObjectList)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected a list of settings", path)
+	}
+	if err := checkKeys(root, ""); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	config := &DaemonConfig{path: path}
+	if err := hcl.DecodeObject(config, root); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}
+
+// Rejects unknown keys, which hcl.Decode would otherwise ignore
+func checkKeys(list *ast.ObjectList, section string) error {
+	for _, item := range list.Items {
+		key := item.Keys[0].Token.Value().(string)
+		if !contains(configKeys[section], key) {
+			if section == "" {
+				return fmt.Errorf("%s: unknown setting '%s'", item.Pos(), key)
+			}
+			return fmt.Errorf("%s: unknown setting '%s' in %s", item.Pos(), key, section)
+		}
+		if _, ok := configKeys[key]; !ok || section != "" {
+			continue
+		}
+		if object, ok := item.Val.(*ast.ObjectType); ok {
+			if err := checkKeys(object.List, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks every setting, returning a Daemon ready to serve clients, or an
+// error listing every problem found
+func (c *DaemonConfig) Daemon() (*Daemon, error) {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	daemon := &Daemon{Listen: c.Listen, Insecure: c.Insecure}
+	if len(daemon.Listen) == 0 {
+		daemon.Listen = []string{DefaultListen}
+	}
+	for _, address := range daemon.Listen {
+		if _, port, err := net.SplitHostPort(address); err != nil {
+			problem("listen: %v", err)
+		} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+			problem("listen: invalid port in %s", address)
+		}
+	}
+
+	if c.TLS != nil {
+		mgr := &pki.PKI{Config: &pki.Config{
+			ServerCertPath: c.TLS.Cert,
+			ServerKeyPath:  c.TLS.Key,
+			CaCertPath:     c.TLS.CACert,
+			Insecure:       c.Insecure,
+		}}
+		if c.TLS.Cert == "" || c.TLS.Key == "" || c.TLS.CACert == "" {
+			problem("tls: cert, key and ca_cert are all required")
+		} else if _, err := os.Stat(c.TLS.CACert); err != nil {
+			problem("tls: %v", err)
+		} else if daemon.TLS, err = mgr.GetServerTLSConfig(); err != nil {
+			problem("tls: %v", err)
+		}
+	}
+
+	if c.Root != "" {
+		if len(c.Exports) > 0 {
+			problem("root can not be used with exports")
+		}
+		root, err := fs.RootPath(c.Root)
+		if err != nil {
+			problem("root: %v", err)
+		}
+		daemon.FileSystem.Root = root
+	}
+
+	if len(c.Exports) > 0 {
+		daemon.FileSystem.Exports = make(Exports)
+	}
+	for _, e := range c.Exports {
+		export := &Export{Name: e.Name, Path: e.Path, Allow: e.Allow}
+		if e.Mode != "" {
+			mode, err := NewMode(e.Mode)
+			if err != nil {
+				problem("export %s: %v", e.Name, err)
+			}
+			export.Mode = mode
+		}
+		if err := export.validate(); err != nil {
+			problem("export %s: %v", e.Name, err)
+		} else if other := daemon.FileSystem.Exports.Overlapping(export); other != nil && other.Name != e.Name {
+			problem("export %s: %s overlaps export %s (%s), and exports can not be nested", e.Name, export.Path, other.Name, other.Path)
+		}
+		if _, ok := daemon.FileSystem.Exports[e.Name]; ok {
+			problem("export %s is defined more than once", e.Name)
+		}
+		daemon.FileSystem.Exports[e.Name] = export
+	}
+
+	if len(c.Clients) > 0 {
+		daemon.FileSystem.ACL = make(ACL)
+		if c.ACLFile != "" {
+			problem("acl_file can not be used with clients")
+		}
+	} else if c.ACLFile != "" {
+		acl, err := LoadACL(c.ACLFile)
+		if err != nil {
+			problem("acl_file: %v", err)
+		}
+		daemon.FileSystem.ACL = acl
+	}
+	for _, client := range c.Clients {
+		rights := make(Rights)
+		if len(client.Rights) > 0 {
+			var err error
+			if rights, err = ParseRights(strings.Join(client.Rights, ",")); err != nil {
+				problem("client %s: %v", client.Name, err)
+			}
+		}
+		if _, ok := daemon.FileSystem.ACL[client.Name]; ok {
+			problem("client %s is defined more than once", client.Name)
+		}
+		daemon.FileSystem.ACL[client.Name] = rights
+	}
+
+	if c.Log != nil && c.Log.File != "" {
+		if info, err := os.Stat(filepath.Dir(c.Log.File)); err != nil {
+			problem("log: %v", err)
+		} else if !info.IsDir() {
+			problem("log: %s is not a directory", filepath.Dir(c.Log.File))
+		}
+		daemon.LogFile = c.Log.File
+	}
+
+	if c.Limits != nil {
+		if c.Limits.MaxConnections < 0 {
+			problem("limits: max_connections can not be negative")
+		}
+		daemon.MaxConnections = c.Limits.MaxConnections
+		duration := func(name string, value string) time.Duration {
+			if value == "" {
+				return 0
+			}
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				problem("limits: %s: %v", name, err)
+			} else if d < 0 {
+				problem("limits: %s can not be negative", name)
+			}
+			return d
+		}
+		daemon.IdleTimeout = duration("idle_timeout", c.Limits.IdleTimeout)
+		daemon.ShutdownTimeout = duration("shutdown_timeout", c.Limits.ShutdownTimeout)
+	}
+
+	if c.Hooks != nil {
+		daemon.FileSystem.Hooks = *c.Hooks
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%s is invalid:\n  %s", c.path, strings.Join(problems, "\n  "))
+	}
+	return daemon, nil
+}
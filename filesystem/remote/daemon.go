@@ -0,0 +1,275 @@
+package remote
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// A daemon, serving a RemoteFileSystem to clients
+type Daemon struct {
+	FileSystem      RemoteFileSystem
+	Listen          []string      // Addresses to listen on, as host:port
+	TLS             *tls.Config   // The daemon command uses the default certificates of the pki command, if nil
+	Insecure        bool          // Whether clients may connect without a certificate
+	LogFile         string        // Where to log to, in place of stderr
+	MaxConnections  int           // The number of clients served at once. Unlimited, if 0
+	IdleTimeout     time.Duration // How long a client may send nothing before it is disconnected. Forever, if 0
+	ShutdownTimeout time.Duration // How long Shutdown waits for calls in progress. DefaultShutdownTimeout, if 0
+
+	mutex     sync.Mutex
+	listeners []net.Listener
+	clients   map[*serverCodec]bool
+	done      sync.WaitGroup
+	closed    bool
+}
+
+// How long a daemon waits for the calls of its clients to finish, when it
+// is shut down, unless configured otherwise
+const DefaultShutdownTimeout = 30 * time.Second
+
+// Returned by Serve once the Daemon has been shut down
+var ErrDaemonClosed = errors.New("The daemon has been shut down")
+
+// Accepts clients on listener until the Daemon is shut down, or accepting
+// fails for good. Each client gets a TLS connection of its own, served in
+// the background. Temporary errors, such as running out of file
+// descriptors, are retried after a pause that grows up to a second.
+func (d *Daemon) Serve(listener net.Listener) error {
+	d.mutex.Lock()
+	if d.closed {
+		d.mutex.Unlock()
+		listener.Close()
+		return ErrDaemonClosed
+	}
+	d.listeners = append(d.listeners, listener)
+	d.mutex.Unlock()
+
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			d.mutex.Lock()
+			closed := d.closed
+			d.mutex.Unlock()
+			if closed {
+				return ErrDaemonClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				log.Printf("server: accept: %s, retrying in %s", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		log.Printf("server: accepted from %s", conn.RemoteAddr())
+		d.connect(conn)
+	}
+}
+
+// Starts serving a client, with the settings the Daemon has at the time
+func (d *Daemon) connect(conn net.Conn) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		conn.Close()
+		return
+	}
+	if d.MaxConnections > 0 && len(d.clients) >= d.MaxConnections {
+		log.Printf("server: refused %s, already serving %d clients", conn.RemoteAddr(), d.MaxConnections)
+		conn.Close()
+		return
+	}
+	if d.IdleTimeout > 0 {
+		conn = &idleConn{Conn: conn, timeout: d.IdleTimeout}
+	}
+	codec := newServerCodec(tls.Server(conn, d.TLS))
+	if d.clients == nil {
+		d.clients = make(map[*serverCodec]bool)
+	}
+	d.clients[codec] = true
+	d.done.Add(1)
+
+	go func(daemon RemoteFileSystem) {
+		defer d.disconnect(codec)
+		serveCodec(codec, daemon)
+	}(d.FileSystem)
+}
+
+func (d *Daemon) disconnect(codec *serverCodec) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.clients, codec)
+	d.done.Done()
+}
+
+// Takes the settings of next for the clients that connect from now on.
+// Clients already connected keep the settings they had. The addresses
+// listened on can not be changed.
+func (d *Daemon) Reload(next *Daemon) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.FileSystem = next.FileSystem
+	d.TLS = next.TLS
+	d.Insecure = next.Insecure
+	d.LogFile = next.LogFile
+	d.MaxConnections = next.MaxConnections
+	d.IdleTimeout = next.IdleTimeout
+	d.ShutdownTimeout = next.ShutdownTimeout
+}
+
+// Stops accepting clients, and waits up to the ShutdownTimeout for the calls
+// of those connected to be answered, disconnecting each as it goes idle.
+// Any still connected after that are disconnected anyway.
+func (d *Daemon) Shutdown() error {
+	d.mutex.Lock()
+	d.closed = true
+	for _, listener := range d.listeners {
+		listener.Close()
+	}
+	for codec := range d.clients {
+		codec.drain()
+	}
+	timeout := d.ShutdownTimeout
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	d.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.done.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for codec := range d.clients {
+		codec.Close()
+	}
+	return fmt.Errorf("Disconnected %d client(s) with calls still in progress after %s", len(d.clients), timeout)
+}
+
+// A connection that times out once nothing has been sent or received on it
+// for a while
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// Commands run by the daemon as clients come and go, through the shell.
+// Each gets the name of the client in $MIRROR_CLIENT, and its address in
+// $MIRROR_CLIENT_ADDR.
+type Hooks struct {
+	OnConnect    string `hcl:"on_connect"` // The client is disconnected, if this fails
+	OnDisconnect string `hcl:"on_disconnect"`
+}
+
+func (h Hooks) run(command string, f RemoteFileSystem, addr net.Addr) error {
+	if command == "" {
+		return nil
+	}
+	shell, flag := "/bin/sh", "-c"
+	if runtime.GOOS == "windows" {
+		shell, flag = "cmd", "/C"
+	}
+	cmd := exec.Command(shell, flag, command)
+	cmd.Env = append(os.Environ(), "MIRROR_CLIENT="+f.identity(), "MIRROR_CLIENT_ADDR="+addr.String())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v: %s", command, err, output)
+	}
+	return nil
+}
+
+// Serves the RPC calls of a single client until either side closes its
+// connection. Each connection gets its own copy of daemon, which knows who
+// the client is.
+func ServeConn(conn net.Conn, daemon RemoteFileSystem) {
+	serveCodec(newServerCodec(conn), daemon)
+}
+
+func serveCodec(codec *serverCodec, daemon RemoteFileSystem) {
+	conn := codec.conn
+	defer codec.Close()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("server: handshake with %s: %s", conn.RemoteAddr(), err)
+			return
+		}
+		daemon.Peer = peerNames(tlsConn.ConnectionState())
+	}
+	daemon.streams = newStreamTable()
+	defer daemon.streams.abortAll()
+
+	if err := daemon.Hooks.run(daemon.Hooks.OnConnect, daemon, conn.RemoteAddr()); err != nil {
+		log.Printf("server: rejected %s: on_connect hook failed: %v", daemon.identity(), err)
+		return
+	}
+	log.Printf("server: %s connected from %s", daemon.identity(), conn.RemoteAddr())
+	server := rpc.NewServer()
+	server.Register(&daemon)
+	server.ServeCodec(codec)
+	log.Printf("server: %s disconnected", daemon.identity())
+	if err := daemon.Hooks.run(daemon.Hooks.OnDisconnect, daemon, conn.RemoteAddr()); err != nil {
+		log.Printf("server: on_disconnect hook failed: %v", err)
+	}
+}
+
+// The names a client is known by: the common name of its certificate, its
+// subject alternative names, and its whole subject
+func peerNames(state tls.ConnectionState) []string {
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := state.PeerCertificates[0]
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return append(names, cert.Subject.String())
+}
+
+// The name of the client, for the log
+func (f RemoteFileSystem) identity() string {
+	if len(f.Peer) == 0 {
+		return "anonymous"
+	}
+	return f.Peer[0]
+}
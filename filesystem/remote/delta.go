@@ -0,0 +1,185 @@
+package remote
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mefellows/mirror/filesystem"
+	"github.com/mefellows/mirror/filesystem/delta"
+	"github.com/mefellows/mirror/filesystem/fs"
+)
+
+// The maximum number of Operations sent to the daemon in a single call
+const maxPatchOps = 1024
+
+// Remote RPC Types
+type SignatureRequest struct {
+	File      filesystem.File
+	BlockSize int
+}
+
+type SignatureResponse struct {
+	RemoteResponse
+	Signature *delta.Signature
+}
+
+type PatchRequest struct {
+	File      filesystem.File
+	Perm      os.FileMode
+	BlockSize int
+}
+
+type PatchOpsRequest struct {
+	Handle uint64
+	Ops    []delta.Operation
+}
+
+// The signature of a File reveals which blocks of data it holds, so it
+// needs the same Access as reading the File
+func (f RemoteFileSystem) RemoteSignature(req *SignatureRequest, res *SignatureResponse) error {
+	if res.Error = f.authorize(Read, true, &req.File.FilePath); res.Error != nil {
+		return res.Error
+	}
+	file, err := os.Open(req.File.Path())
+	if err != nil {
+		res.Error = err
+		return res.Error
+	}
+	defer file.Close()
+	res.Signature, res.Error = delta.NewSignature(file, req.BlockSize)
+	if res.Error == nil {
+		res.Success = true
+	}
+	return res.Error
+}
+
+// Begins rebuilding a File on the daemon. The new contents are written to a
+// temporary file alongside the original, and moved into place on close.
+func (f RemoteFileSystem) RemotePatch(req *PatchRequest, res *StreamResponse) error {
+	if res.Error = f.authorize(Write, true, &req.File.FilePath); res.Error != nil {
+		return res.Error
+	}
+	base, err := os.Open(req.File.Path())
+	if err != nil {
+		res.Error = err
+		return res.Error
+	}
+	out, err := fs.NewAtomicWriter(req.File, req.Perm)
+	if err != nil {
+		base.Close()
+		res.Error = err
+		return res.Error
+	}
+	res.Handle = f.streams.add(&patchStream{
+		Patcher: delta.NewPatcher(base, req.BlockSize, out),
+		base:    base,
+		out:     out,
+		path:    req.File.Path(),
+	})
+	res.Success = true
+	return nil
+}
+
+func (f RemoteFileSystem) RemotePatchOps(req *PatchOpsRequest, res *RemoteResponse) error {
+	stream, err := f.streams.get(req.Handle)
+	if err != nil {
+		res.Error = err
+		return res.Error
+	}
+	patch, ok := stream.(*patchStream)
+	if !ok {
+		res.Error = fmt.Errorf("Stream %d is not open for patching", req.Handle)
+		return res.Error
+	}
+	for _, op := range req.Ops {
+		if res.Error = patch.WriteOp(op); res.Error != nil {
+			patch.failed = true
+			return res.Error
+		}
+	}
+	res.Success = true
+	return nil
+}
+
+// Daemon side of a patch: applies Operations to a temporary file,
+// replacing the original File only if every Operation succeeded
+type patchStream struct {
+	*delta.Patcher
+	base   *os.File
+	out    *fs.AtomicWriter
+	path   string
+	failed bool
+}
+
+func (p *patchStream) Abort() error {
+	p.failed = true
+	return p.Close()
+}
+
+func (p *patchStream) Close() error {
+	p.base.Close()
+	if p.failed {
+		p.out.Abort()
+		return fmt.Errorf("Patch of %s was aborted", p.path)
+	}
+	return p.out.Close()
+}
+
+func (f RemoteFileSystem) Signature(file filesystem.File, blockSize int) (*delta.Signature, error) {
+	rpcargs := &SignatureRequest{File: file, BlockSize: blockSize}
+	var reply SignatureResponse
+	err := f.client.Call("RemoteFileSystem.RemoteSignature", rpcargs, &reply)
+	return reply.Signature, err
+}
+
+func (f RemoteFileSystem) Patch(file filesystem.File, perm os.FileMode, blockSize int) (delta.PatchWriter, error) {
+	rpcargs := &PatchRequest{File: file, Perm: perm, BlockSize: blockSize}
+	var reply StreamResponse
+	if err := f.client.Call("RemoteFileSystem.RemotePatch", rpcargs, &reply); err != nil {
+		return nil, err
+	}
+	return &remotePatcher{client: f, handle: reply.Handle}, nil
+}
+
+// Client side of a patch, batching Operations before sending them to the daemon
+type remotePatcher struct {
+	client RemoteFileSystem
+	handle uint64
+	ops    []delta.Operation
+	size   int
+}
+
+func (p *remotePatcher) WriteOp(op delta.Operation) error {
+	p.ops = append(p.ops, op)
+	p.size += len(op.Data)
+	if len(p.ops) >= maxPatchOps || p.size >= StreamChunkSize {
+		return p.flush()
+	}
+	return nil
+}
+
+func (p *remotePatcher) flush() error {
+	if len(p.ops) == 0 {
+		return nil
+	}
+	rpcargs := &PatchOpsRequest{Handle: p.handle, Ops: p.ops}
+	var reply RemoteResponse
+	err := p.client.client.Call("RemoteFileSystem.RemotePatchOps", rpcargs, &reply)
+	p.ops = nil
+	p.size = 0
+	return err
+}
+
+func (p *remotePatcher) Close() error {
+	err := p.flush()
+	var reply RemoteResponse
+	if cerr := p.client.client.Call("RemoteFileSystem.RemoteClose", &CloseRequest{Handle: p.handle}, &reply); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (p *remotePatcher) Abort() error {
+	var reply RemoteResponse
+	return p.client.client.Call("RemoteFileSystem.RemoteAbort", &CloseRequest{Handle: p.handle}, &reply)
+}
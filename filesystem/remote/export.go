@@ -0,0 +1,212 @@
+package remote
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/mefellows/mirror/filesystem"
+	"github.com/mefellows/mirror/filesystem/fs"
+)
+
+// What a client wants to do with a path on the daemon
+type Access int
+
+const (
+	List   Access = iota // Read the metadata of a File
+	Read                 // Read the contents, hash or block signature of a File
+	Write                // Create or change a File
+	Delete               // Remove a File
+)
+
+func (a Access) String() string {
+	return [...]string{"list", "read", "write", "delete"}[a]
+}
+
+// What clients may do with an Export
+type Mode int
+
+const (
+	ReadWrite Mode = iota
+	ReadOnly       // Files can be listed and read
+	WriteOnly      // Files can be listed, written and deleted, but not read back
+)
+
+func (m Mode) String() string {
+	return [...]string{"rw", "ro", "wo"}[m]
+}
+
+func NewMode(name string) (Mode, error) {
+	for _, mode := range []Mode{ReadWrite, ReadOnly, WriteOnly} {
+		if mode.String() == name {
+			return mode, nil
+		}
+	}
+	return ReadWrite, fmt.Errorf("Unknown export mode '%s'. Available modes: rw, ro, wo", name)
+}
+
+func (m Mode) allows(access Access) bool {
+	switch m {
+	case ReadOnly:
+		return access == List || access == Read
+	case WriteOnly:
+		return access != Read
+	}
+	return true
+}
+
+// A directory on the daemon that clients reach by name, so that
+// mirror://host/backups/foo is foo inside the directory of the
+// "backups" Export
+type Export struct {
+	Name  string
+	Path  string   // Absolute, with any symlinks resolved
+	Mode  Mode     // What clients may do with it
+	Allow []string // Subjects or common names of the client certificates that may use it. Anyone may, if empty
+}
+
+// Parses an Export given as NAME=PATH[,MODE[,SUBJECT...]]
+func ParseExport(spec string) (*Export, error) {
+	eq := strings.Index(spec, "=")
+	if eq <= 0 {
+		return nil, fmt.Errorf("Invalid export '%s', expected NAME=PATH[,MODE[,SUBJECT...]]", spec)
+	}
+	parts := strings.Split(spec[eq+1:], ",")
+	export := &Export{Name: spec[:eq], Path: parts[0]}
+	if len(parts) > 1 {
+		mode, err := NewMode(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		export.Mode = mode
+	}
+	if len(parts) > 2 {
+		export.Allow = parts[2:]
+	}
+	return export, export.validate()
+}
+
+// Checks the Name, and resolves the Path of an Export
+func (e *Export) validate() error {
+	if e.Name == "" || e.Name == "." || e.Name == ".." || strings.ContainsAny(e.Name, `/\`) {
+		return fmt.Errorf("Invalid export name '%s'", e.Name)
+	}
+	path, err := fs.RootPath(e.Path)
+	if err != nil {
+		return fmt.Errorf("Invalid path for export '%s': %v", e.Name, err)
+	}
+	e.Path = path
+	return nil
+}
+
+// Whether a client known by any of names may use the Export
+func (e *Export) allowed(names []string) bool {
+	if len(e.Allow) == 0 {
+		return true
+	}
+	for _, allowed := range e.Allow {
+		for _, name := range names {
+			if allowed == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Exports by name. The paths of Exports may not overlap, so that every path
+// on the daemon belongs to at most one of them
+type Exports map[string]*Export
+
+// The Export whose path is the same as, inside or contains that of export, or nil
+func (e Exports) Overlapping(export *Export) *Export {
+	for _, other := range e {
+		if within(export.Path, other.Path) || within(other.Path, export.Path) {
+			return other
+		}
+	}
+	return nil
+}
+
+// Whether path is dir, or inside it
+func within(path string, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// Maps a path sent by a client to the path on the daemon, checking that
+// the client may access it. The ACL is checked first, then, with Exports,
+// the first element of the path names the Export. Otherwise, paths are
+// used as they are, but must be inside the Root, if there is one.
+//
+// If follow is false, a symlink at the path itself is not followed. See fs.Within
+func (f RemoteFileSystem) authorize(access Access, follow bool, paths ...*string) error {
+	for _, path := range paths {
+		log.Printf("%s: %s %s", f.identity(), access, *path)
+		if f.ACL != nil && !f.ACL.allows(f.Peer, access) {
+			err := fmt.Errorf("Access denied: %s may not %s files", f.identity(), access)
+			log.Printf("Rejected %s of %s: %v", access, *path, err)
+			return err
+		}
+		if len(f.Exports) > 0 {
+			real, err := f.exportPath(access, *path)
+			if err != nil {
+				log.Printf("Rejected %s of %s: %v", access, *path, err)
+				return err
+			}
+			*path = real
+		}
+		if err := f.confine(follow, *path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f RemoteFileSystem) exportPath(access Access, path string) (string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(filepath.ToSlash(path), "/"), "/", 2)
+	export, ok := f.Exports[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("Access denied: no export named '%s'", parts[0])
+	}
+	if !export.allowed(f.Peer) {
+		return "", fmt.Errorf("Access denied: export '%s' does not allow this client", export.Name)
+	}
+	if !export.Mode.allows(access) {
+		return "", fmt.Errorf("Access denied: export '%s' is %s, and can not be used to %s files", export.Name, export.Mode, access)
+	}
+	if len(parts) == 1 {
+		return export.Path, nil
+	}
+	return export.Path + string(filepath.Separator) + filepath.FromSlash(parts[1]), nil
+}
+
+// Maps a path on the daemon back to the path the client knows it by
+func (f RemoteFileSystem) clientPath(path string) string {
+	for _, export := range f.Exports {
+		if path == export.Path {
+			return "/" + export.Name
+		}
+		if strings.HasPrefix(path, export.Path+string(filepath.Separator)) {
+			return "/" + export.Name + filepath.ToSlash(path[len(export.Path):])
+		}
+	}
+	return path
+}
+
+// Maps the path of a File on the daemon back to the one the client knows
+func (f RemoteFileSystem) clientFile(file *filesystem.File) {
+	if len(f.Exports) > 0 {
+		file.FilePath = f.clientPath(file.FilePath)
+	}
+}
+
+func (f RemoteFileSystem) clientTree(tree *filesystem.FileTree) {
+	if tree == nil {
+		return
+	}
+	f.clientFile(&tree.StdFile)
+	for _, child := range tree.StdChildNodes {
+		f.clientTree(child)
+	}
+}
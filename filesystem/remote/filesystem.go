@@ -1,17 +1,21 @@
 package remote
 
 import (
+	"bytes"
 	"crypto/tls"
 	"fmt"
 	"github.com/mefellows/mirror/filesystem"
 	"github.com/mefellows/mirror/filesystem/fs"
 	"github.com/mefellows/mirror/mirror"
 	"github.com/mefellows/mirror/pki"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/rpc"
 	neturl "net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -25,6 +29,14 @@ type RemoteFileSystem struct {
 	rootUrl neturl.URL
 	// TODO: Embed the RPC Client in here and wrap the write
 	client *rpc.Client
+
+	// On the daemon
+	Root    string   // The directory that clients are confined to, if any
+	Exports Exports  // Directories that clients reach by name, in place of the Root
+	ACL     ACL      // What each client may do. Clients may do anything, if nil
+	Hooks   Hooks    // Run as clients connect and disconnect
+	Peer    []string // The names the client is known by, from its certificate
+	streams *streamTable
 }
 
 func init() {
@@ -65,6 +77,36 @@ func NewRemoteFileSystem(url string) (filesystem.FileSystem, error) {
 	return RemoteFileSystem{rootUrl: *uri, client: client}, err
 }
 
+// Checks that paths on the daemon are inside the Export they belong to, or
+// the daemon's Root, if it has one. See fs.Within
+func (f RemoteFileSystem) confine(follow bool, paths ...string) error {
+	for _, path := range paths {
+		root := f.rootOf(path)
+		if root == "" && len(f.Exports) > 0 {
+			return fmt.Errorf("Access denied: %s is not in an export", path)
+		}
+		if root == "" {
+			continue
+		}
+		if err := fs.Within(root, path, follow); err != nil {
+			log.Printf("Rejected request: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// The directory on the daemon that contains path: the Export it is in, or the Root.
+// Exports don't overlap, so at most one contains it
+func (f RemoteFileSystem) rootOf(path string) string {
+	for _, export := range f.Exports {
+		if path == export.Path || strings.HasPrefix(path, export.Path+string(filepath.Separator)) {
+			return export.Path
+		}
+	}
+	return f.Root
+}
+
 // Remote RPC Types
 type RemoteResponse struct {
 	Success bool
@@ -82,7 +124,9 @@ type WriteResponse struct {
 }
 
 type ReadFileRequest struct {
-	File string
+	File     string
+	Symlinks filesystem.SymlinkPolicy
+	Xattrs   bool
 }
 
 type ReadFileResponse struct {
@@ -100,7 +144,9 @@ type ReadResponse struct {
 }
 
 type FileMapRequest struct {
-	File filesystem.File
+	File     filesystem.File
+	Symlinks filesystem.SymlinkPolicy
+	Xattrs   bool
 }
 
 type FileMapResponse struct {
@@ -109,7 +155,9 @@ type FileMapResponse struct {
 }
 
 type FileTreeRequest struct {
-	File filesystem.File
+	File     filesystem.File
+	Symlinks filesystem.SymlinkPolicy
+	Xattrs   bool
 }
 
 type FileTreeResponse struct {
@@ -118,7 +166,9 @@ type FileTreeResponse struct {
 }
 
 type DirRequest struct {
-	File string
+	File     string
+	Symlinks filesystem.SymlinkPolicy
+	Xattrs   bool
 }
 
 type DirResponse struct {
@@ -142,70 +192,143 @@ type MkDirResponse struct {
 	RemoteResponse
 }
 
+type ChmodRequest struct {
+	File filesystem.File
+	Perm os.FileMode
+}
+
+type SymlinkRequest struct {
+	File   filesystem.File
+	Target string
+}
+
+type LinkRequest struct {
+	File     filesystem.File
+	Existing filesystem.File
+}
+
+type MknodRequest struct {
+	File filesystem.File
+}
+
+type SetXattrsRequest struct {
+	File   filesystem.File
+	Xattrs filesystem.Xattrs
+}
+
+type ChownRequest struct {
+	File  filesystem.File
+	Owner int
+	Group int
+}
+
+type HashRequest struct {
+	File      filesystem.File
+	Algorithm string
+}
+
+type HashResponse struct {
+	RemoteResponse
+	Hash string
+}
+
 func (f *RemoteFileSystem) RemoteWrite(req *WriteRequest, res *RemoteResponse) error {
+	if res.Error = f.authorize(Write, false, &req.File.FilePath); res.Error != nil {
+		return res.Error
+	}
 	fsys := fs.StdFileSystem{}
 	res.Error = fsys.Write(req.File, req.Data, req.Perm)
 	if res.Error == nil {
 		res.Success = true
 	}
-	log.Printf("Writing to file on remote side: %s @ %s. Error? %v\n", req.File.Name(), req.File.Path())
+	log.Printf("Writing to file on remote side: %s @ %s. Error? %v\n", req.File.Name(), req.File.Path(), res.Error)
 	return res.Error
 }
 
+// Write streams the data to the daemon in chunks, rather than shipping
+// the whole payload in a single RPC call.
 func (f RemoteFileSystem) Write(file filesystem.File, data []byte, perm os.FileMode) (err error) {
-	// Perform remote operation
-	rpcargs := &WriteRequest{file, data, perm}
-	var reply RemoteResponse
-	err = f.client.Call("RemoteFileSystem.RemoteWrite", rpcargs, &reply)
-	return err
+	w, err := f.Create(file, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, bytes.NewReader(data)); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
 }
 
 func (f RemoteFileSystem) RemoteRead(req *ReadRequest, res *ReadResponse) error {
+	if res.Error = f.authorize(Read, true, &req.File.FilePath); res.Error != nil {
+		return res.Error
+	}
 	fsys := fs.StdFileSystem{}
 	res.Data, res.Error = fsys.Read(req.File)
 	return res.Error
 }
 
 func (f RemoteFileSystem) Read(file filesystem.File) ([]byte, error) {
-	rpcargs := &ReadRequest{File: file}
-	var reply ReadResponse
-	f.client.Call("RemoteFileSystem.RemoteRead", rpcargs, &reply)
-
-	return reply.Data, reply.Error
+	r, err := f.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
 }
 
 func (f RemoteFileSystem) RemoteFileMap(req *FileMapRequest, res *FileMapResponse) error {
-	fsys, err := fs.NewStdFileSystem(f.rootUrl.Path)
-	if err == nil {
-		res.FileMap = fsys.FileMap(req.File)
-	} else {
-		res.Error = err
+	if res.Error = f.authorize(List, true, &req.File.FilePath); res.Error != nil {
+		return res.Error
+	}
+	fsys := fs.StdFileSystem{Symlinks: req.Symlinks, Xattrs: req.Xattrs, Root: f.rootOf(req.File.Path())}
+	if res.FileMap, res.Error = fsys.FileMap(req.File); res.Error != nil {
+		return res.Error
+	}
+	for path, file := range res.FileMap {
+		f.clientFile(&file)
+		res.FileMap[path] = file
 	}
 	return res.Error
 }
 
-func (f RemoteFileSystem) FileMap(file filesystem.File) filesystem.FileMap {
-	rpcargs := &FileMapRequest{File: file}
+func (f RemoteFileSystem) FileMap(file filesystem.File) (filesystem.FileMap, error) {
+	rpcargs := &FileMapRequest{File: file, Symlinks: fs.Symlinks, Xattrs: fs.Xattrs}
 	var reply FileMapResponse
-	f.client.Call("RemoteFileSystem.RemoteFileMap", rpcargs, &reply)
-	return reply.FileMap
+	if err := f.client.Call("RemoteFileSystem.RemoteFileMap", rpcargs, &reply); err != nil {
+		return nil, err
+	}
+	return reply.FileMap, nil
 }
 
 func (f RemoteFileSystem) RemoteFileTree(req *FileTreeRequest, res *FileTreeResponse) error {
-	fsys := fs.StdFileSystem{}
+	if res.Error = f.authorize(List, true, &req.File.FilePath); res.Error != nil {
+		return res.Error
+	}
+	fsys := fs.StdFileSystem{Symlinks: req.Symlinks, Xattrs: req.Xattrs, Root: f.rootOf(req.File.Path())}
 	res.FileTree = fsys.FileTree(req.File)
+	f.clientTree(res.FileTree)
 	return res.Error
 }
 
 func (f RemoteFileSystem) FileTree(file filesystem.File) *filesystem.FileTree {
-	rpcargs := &FileTreeRequest{File: file}
+	rpcargs := &FileTreeRequest{File: file, Symlinks: fs.Symlinks, Xattrs: fs.Xattrs}
 	var reply FileTreeResponse
 	f.client.Call("RemoteFileSystem.RemoteFileTree", rpcargs, &reply)
 
 	return reply.FileTree
 }
 
+// The daemon's Root itself can not be deleted, only its contents, and
+// likewise for Exports
 func (f RemoteFileSystem) RemoteDelete(req *DeleteRequest, res *DeleteResponse) error {
+	if res.Error = f.authorize(Delete, false, &req.File); res.Error != nil {
+		return res.Error
+	}
+	if root := f.rootOf(req.File); root != "" && filepath.Clean(req.File) == root {
+		res.Error = fmt.Errorf("Access denied: %s is the root of the daemon, and can not be deleted", f.clientPath(req.File))
+		return res.Error
+	}
 	fsys := fs.StdFileSystem{}
 	res.Error = fsys.Delete(req.File)
 	return res.Error
@@ -214,19 +337,23 @@ func (f RemoteFileSystem) RemoteDelete(req *DeleteRequest, res *DeleteResponse)
 func (f RemoteFileSystem) Delete(file string) error {
 	rpcargs := &DeleteRequest{File: file}
 	var reply DeleteResponse
-	f.client.Call("RemoteFileSystem.RemoteDelete", rpcargs, &reply)
-
-	return reply.Error
+	return f.client.Call("RemoteFileSystem.RemoteDelete", rpcargs, &reply)
 }
 
 func (f RemoteFileSystem) RemoteDir(req *DirRequest, res *DirResponse) error {
-	fsys := fs.StdFileSystem{}
+	if res.Error = f.authorize(List, true, &req.File); res.Error != nil {
+		return res.Error
+	}
+	fsys := fs.StdFileSystem{Symlinks: req.Symlinks, Xattrs: req.Xattrs, Root: f.rootOf(req.File)}
 	res.Files, res.Error = fsys.Dir(req.File)
+	for i := range res.Files {
+		f.clientFile(&res.Files[i])
+	}
 	return res.Error
 }
 
 func (f RemoteFileSystem) Dir(dir string) ([]filesystem.File, error) {
-	rpcargs := &DirRequest{File: dir}
+	rpcargs := &DirRequest{File: dir, Symlinks: fs.Symlinks, Xattrs: fs.Xattrs}
 	var reply DirResponse
 	err := f.client.Call("RemoteFileSystem.RemoteDir", rpcargs, &reply)
 
@@ -234,13 +361,17 @@ func (f RemoteFileSystem) Dir(dir string) ([]filesystem.File, error) {
 }
 
 func (f RemoteFileSystem) RemoteReadFile(req *ReadFileRequest, res *ReadFileResponse) error {
-	fsys := fs.StdFileSystem{}
+	if res.Error = f.authorize(List, false, &req.File); res.Error != nil {
+		return res.Error
+	}
+	fsys := fs.StdFileSystem{Symlinks: req.Symlinks, Xattrs: req.Xattrs, Root: f.rootOf(req.File)}
 	res.File, res.Error = fsys.ReadFile(req.File)
+	f.clientFile(&res.File)
 	return res.Error
 }
 
 func (f RemoteFileSystem) ReadFile(file string) (filesystem.File, error) {
-	rpcargs := &ReadFileRequest{File: file}
+	rpcargs := &ReadFileRequest{File: file, Symlinks: fs.Symlinks, Xattrs: fs.Xattrs}
 	var reply ReadFileResponse
 	err := f.client.Call("RemoteFileSystem.RemoteReadFile", rpcargs, &reply)
 
@@ -248,6 +379,9 @@ func (f RemoteFileSystem) ReadFile(file string) (filesystem.File, error) {
 }
 
 func (f RemoteFileSystem) RemoteMkDir(req *MkDirRequest, res *MkDirResponse) error {
+	if res.Error = f.authorize(Write, false, &req.File.FilePath); res.Error != nil {
+		return res.Error
+	}
 	fsys := fs.StdFileSystem{}
 	res.Error = fsys.MkDir(req.File)
 	if res.Error == nil {
@@ -262,3 +396,147 @@ func (f RemoteFileSystem) MkDir(file filesystem.File) error {
 
 	return err
 }
+
+func (f RemoteFileSystem) RemoteChmod(req *ChmodRequest, res *RemoteResponse) error {
+	if res.Error = f.authorize(Write, true, &req.File.FilePath); res.Error != nil {
+		return res.Error
+	}
+	fsys := fs.StdFileSystem{}
+	res.Error = fsys.Chmod(req.File, req.Perm)
+	if res.Error == nil {
+		res.Success = true
+	}
+	return res.Error
+}
+
+func (f RemoteFileSystem) Chmod(file filesystem.File, perm os.FileMode) error {
+	rpcargs := &ChmodRequest{File: file, Perm: perm}
+	var reply RemoteResponse
+	err := f.client.Call("RemoteFileSystem.RemoteChmod", rpcargs, &reply)
+
+	return err
+}
+
+func (f RemoteFileSystem) RemoteSymlink(req *SymlinkRequest, res *RemoteResponse) error {
+	if res.Error = f.authorize(Write, false, &req.File.FilePath); res.Error != nil {
+		return res.Error
+	}
+	fsys := fs.StdFileSystem{}
+	res.Error = fsys.Symlink(req.File, req.Target)
+	if res.Error == nil {
+		res.Success = true
+	}
+	return res.Error
+}
+
+func (f RemoteFileSystem) Symlink(file filesystem.File, target string) error {
+	rpcargs := &SymlinkRequest{File: file, Target: target}
+	var reply RemoteResponse
+	err := f.client.Call("RemoteFileSystem.RemoteSymlink", rpcargs, &reply)
+
+	return err
+}
+
+func (f RemoteFileSystem) RemoteLink(req *LinkRequest, res *RemoteResponse) error {
+	if res.Error = f.authorize(Write, false, &req.File.FilePath); res.Error != nil {
+		return res.Error
+	}
+	if res.Error = f.authorize(Write, true, &req.Existing.FilePath); res.Error != nil {
+		return res.Error
+	}
+	fsys := fs.StdFileSystem{}
+	res.Error = fsys.Link(req.File, req.Existing)
+	if res.Error == nil {
+		res.Success = true
+	}
+	return res.Error
+}
+
+func (f RemoteFileSystem) Link(file filesystem.File, existing filesystem.File) error {
+	rpcargs := &LinkRequest{File: file, Existing: existing}
+	var reply RemoteResponse
+	err := f.client.Call("RemoteFileSystem.RemoteLink", rpcargs, &reply)
+
+	return err
+}
+
+func (f RemoteFileSystem) RemoteMknod(req *MknodRequest, res *RemoteResponse) error {
+	if res.Error = f.authorize(Write, false, &req.File.FilePath); res.Error != nil {
+		return res.Error
+	}
+	fsys := fs.StdFileSystem{}
+	res.Error = fsys.Mknod(req.File)
+	if res.Error == nil {
+		res.Success = true
+	}
+	return res.Error
+}
+
+func (f RemoteFileSystem) Mknod(file filesystem.File) error {
+	rpcargs := &MknodRequest{File: file}
+	var reply RemoteResponse
+	err := f.client.Call("RemoteFileSystem.RemoteMknod", rpcargs, &reply)
+
+	return err
+}
+
+func (f RemoteFileSystem) RemoteSetXattrs(req *SetXattrsRequest, res *RemoteResponse) error {
+	if res.Error = f.authorize(Write, true, &req.File.FilePath); res.Error != nil {
+		return res.Error
+	}
+	fsys := fs.StdFileSystem{}
+	res.Error = fsys.SetXattrs(req.File, req.Xattrs)
+	if res.Error == nil {
+		res.Success = true
+	}
+	return res.Error
+}
+
+func (f RemoteFileSystem) SetXattrs(file filesystem.File, attrs filesystem.Xattrs) error {
+	rpcargs := &SetXattrsRequest{File: file, Xattrs: attrs}
+	var reply RemoteResponse
+	err := f.client.Call("RemoteFileSystem.RemoteSetXattrs", rpcargs, &reply)
+
+	return err
+}
+
+func (f RemoteFileSystem) RemoteChown(req *ChownRequest, res *RemoteResponse) error {
+	if res.Error = f.authorize(Write, false, &req.File.FilePath); res.Error != nil {
+		return res.Error
+	}
+	fsys := fs.StdFileSystem{}
+	res.Error = fsys.Chown(req.File, req.Owner, req.Group)
+	if res.Error == nil {
+		res.Success = true
+	}
+	return res.Error
+}
+
+func (f RemoteFileSystem) Chown(file filesystem.File, owner int, group int) error {
+	rpcargs := &ChownRequest{File: file, Owner: owner, Group: group}
+	var reply RemoteResponse
+	err := f.client.Call("RemoteFileSystem.RemoteChown", rpcargs, &reply)
+
+	return err
+}
+
+func (f RemoteFileSystem) RemoteHash(req *HashRequest, res *HashResponse) error {
+	if res.Error = f.authorize(Read, true, &req.File.FilePath); res.Error != nil {
+		return res.Error
+	}
+	fsys := fs.StdFileSystem{}
+	res.Hash, res.Error = filesystem.StreamHash(fsys, req.File, req.Algorithm)
+	if res.Error == nil {
+		res.Success = true
+	}
+	return res.Error
+}
+
+// Hash computes the hash on the daemon, so the File need not be transferred
+func (f RemoteFileSystem) Hash(file filesystem.File, algorithm string) (string, error) {
+	rpcargs := &HashRequest{File: file, Algorithm: algorithm}
+	var reply HashResponse
+	err := f.client.Call("RemoteFileSystem.RemoteHash", rpcargs, &reply)
+
+	return reply.Hash, err
+}
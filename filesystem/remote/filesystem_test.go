@@ -1 +1,623 @@
 package remote
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mefellows/mirror/filesystem"
+	"github.com/mefellows/mirror/filesystem/delta"
+	"github.com/mefellows/mirror/filesystem/fs"
+)
+
+// Connect a client RemoteFileSystem to an in-process RPC server
+func testRemoteFileSystem() RemoteFileSystem {
+	return testDaemon(new(RemoteFileSystem))
+}
+
+// Connect a client RemoteFileSystem to an in-process RPC server, using
+// daemon to handle its calls
+func testDaemon(daemon *RemoteFileSystem) RemoteFileSystem {
+	client, server := net.Pipe()
+	go ServeConn(server, *daemon)
+	return RemoteFileSystem{client: rpc.NewClient(client)}
+}
+
+func TestRemoteWriteRead_Streamed(t *testing.T) {
+	fs := testRemoteFileSystem()
+	dir, _ := ioutil.TempDir("", "mirror-remote-test")
+	defer os.RemoveAll(dir)
+
+	// Larger than a single chunk, so it must be split across calls
+	data := make([]byte, StreamChunkSize*2+123)
+	rand.Read(data)
+	file := filesystem.File{FileName: "big.bin", FilePath: filepath.Join(dir, "big.bin")}
+
+	if err := fs.Write(file, data, 0644); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	onDisk, _ := ioutil.ReadFile(file.Path())
+	if !bytes.Equal(onDisk, data) {
+		t.Fatalf("Expected %d bytes on disk to match, got %d", len(data), len(onDisk))
+	}
+
+	read, err := fs.Read(file)
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatalf("Expected %d bytes to be read back, got %d", len(data), len(read))
+	}
+}
+
+func TestRemoteOpen_Missing(t *testing.T) {
+	fs := testRemoteFileSystem()
+	_, err := fs.Open(filesystem.File{FilePath: "/this/does/not/exist"})
+	if err == nil {
+		t.Fatalf("Expected err")
+	}
+}
+
+func TestRemotePatch(t *testing.T) {
+	fs := testRemoteFileSystem()
+	dir, _ := ioutil.TempDir("", "mirror-remote-test")
+	defer os.RemoveAll(dir)
+
+	old := make([]byte, 256*1024)
+	rand.Read(old)
+	new := make([]byte, len(old))
+	copy(new, old)
+	copy(new[1000:], []byte("some changed bytes"))
+
+	file := filesystem.File{FileName: "delta.bin", FilePath: filepath.Join(dir, "delta.bin")}
+	ioutil.WriteFile(file.Path(), old, 0644)
+
+	sig, err := fs.Signature(file, 4096)
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if len(sig.Blocks) != 64 {
+		t.Fatalf("Expected 64 blocks in signature, got %d", len(sig.Blocks))
+	}
+
+	w, err := fs.Patch(file, 0644, sig.BlockSize)
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if err = delta.Delta(sig, bytes.NewReader(new), w); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+
+	onDisk, _ := ioutil.ReadFile(file.Path())
+	if !bytes.Equal(onDisk, new) {
+		t.Fatalf("Expected patched file to match the new contents")
+	}
+}
+
+func TestRemotePatch_Abort(t *testing.T) {
+	fs := testRemoteFileSystem()
+	dir, _ := ioutil.TempDir("", "mirror-remote-test")
+	defer os.RemoveAll(dir)
+
+	file := filesystem.File{FileName: "delta.txt", FilePath: filepath.Join(dir, "delta.txt")}
+	ioutil.WriteFile(file.Path(), []byte("original"), 0644)
+
+	w, _ := fs.Patch(file, 0644, 4096)
+	w.WriteOp(delta.Operation{Type: delta.OpData, Data: []byte("partial")})
+	w.Abort()
+
+	onDisk, _ := ioutil.ReadFile(file.Path())
+	if string(onDisk) != "original" {
+		t.Fatalf("Expected aborted patch to leave the file untouched, got %s", onDisk)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("Expected temporary files to be removed, found %d files", len(files))
+	}
+}
+
+func TestRemoteCreate_Abort(t *testing.T) {
+	fs := testRemoteFileSystem()
+	dir, _ := ioutil.TempDir("", "mirror-remote-test")
+	defer os.RemoveAll(dir)
+
+	file := filesystem.File{FileName: "stream.txt", FilePath: filepath.Join(dir, "stream.txt")}
+	ioutil.WriteFile(file.Path(), []byte("original"), 0644)
+
+	w, _ := fs.Create(file, 0644)
+	w.Write(make([]byte, StreamChunkSize+1))
+	w.(filesystem.AbortWriter).Abort()
+
+	onDisk, _ := ioutil.ReadFile(file.Path())
+	if string(onDisk) != "original" {
+		t.Fatalf("Expected aborted write to leave the file untouched, got %d bytes", len(onDisk))
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("Expected temporary files to be removed, found %d files", len(files))
+	}
+}
+
+func TestRemoteResume(t *testing.T) {
+	fs := testRemoteFileSystem()
+	dir, _ := ioutil.TempDir("", "mirror-remote-test")
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 3*StreamChunkSize)
+	rand.Read(data)
+	file := filesystem.File{FileName: "big.bin", FilePath: filepath.Join(dir, "big.bin")}
+
+	// Interrupted part way through
+	w, err := fs.Resume(file, 0644, 0, filesystem.MD5)
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	w.Write(data[:StreamChunkSize+100])
+	w.Abort()
+	if _, err = os.Stat(file.Path()); !os.IsNotExist(err) {
+		t.Fatalf("Expected an interrupted file not to be moved into place")
+	}
+	if listing, err := fs.Dir(dir); err != nil || len(listing) != 0 {
+		t.Fatalf("Expected the partial file not to be listed, got %v: %v", listing, err)
+	}
+
+	sig, err := fs.PartialSignature(file, 4096)
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	offset, _, _ := delta.MatchPrefix(sig, bytes.NewReader(data))
+	if offset != StreamChunkSize+100-100%4096 {
+		t.Fatalf("Expected to resume from the last whole block, got offset %d", offset)
+	}
+
+	// A checksum mismatch discards the partial file
+	w, _ = fs.Resume(file, 0644, offset, filesystem.MD5)
+	w.Write(data[offset:])
+	if err = w.Commit("bogus"); err == nil {
+		t.Fatalf("Expected a checksum mismatch")
+	}
+	if sig, _ = fs.PartialSignature(file, 4096); len(sig.Blocks) != 0 {
+		t.Fatalf("Expected the partial file to be discarded")
+	}
+
+	w, _ = fs.Resume(file, 0644, 0, filesystem.MD5)
+	w.Write(data)
+	if err = w.Commit(fmt.Sprintf("%x", md5.Sum(data))); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	onDisk, _ := ioutil.ReadFile(file.Path())
+	if !bytes.Equal(onDisk, data) {
+		t.Fatalf("Expected resumed file to match")
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("Expected the partial file to be moved into place, found %d files", len(files))
+	}
+}
+
+func TestRemoteRoot(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "mirror-remote-test")
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "root"), 0755)
+	root, _ := fs.RootPath(filepath.Join(dir, "root"))
+	remote := testDaemon(&RemoteFileSystem{Root: root})
+
+	inside := filesystem.File{FileName: "in.txt", FilePath: filepath.Join(root, "in.txt")}
+	if err := remote.Write(inside, []byte("in"), 0644); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+
+	outside := filesystem.File{FileName: "out.txt", FilePath: filepath.Join(dir, "out.txt")}
+	if err := remote.Write(outside, []byte("out"), 0644); err == nil || !strings.Contains(err.Error(), "Access denied") {
+		t.Fatalf("Expected writing outside of the root to be denied, got %v", err)
+	}
+	traversal := filesystem.File{FileName: "out.txt", FilePath: root + "/../out.txt"}
+	if err := remote.Write(traversal, []byte("out"), 0644); err == nil {
+		t.Fatalf("Expected writing through '..' to be denied")
+	}
+	if _, err := os.Stat(outside.Path()); !os.IsNotExist(err) {
+		t.Fatalf("Expected nothing to be written outside of the root")
+	}
+
+	if err := remote.Delete(dir); err == nil {
+		t.Fatalf("Expected deleting outside of the root to be denied")
+	}
+	if err := remote.Delete(root); err == nil {
+		t.Fatalf("Expected deleting the root to be denied")
+	}
+	if _, err := remote.ReadFile(inside.Path()); err != nil {
+		t.Fatalf("Expected the root and its contents to be kept: %v", err)
+	}
+}
+
+func TestParseExport(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "mirror-remote-test")
+	defer os.RemoveAll(dir)
+
+	export, err := ParseExport("backups=" + dir + ",ro,alice,bob")
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if export.Name != "backups" || export.Mode != ReadOnly || len(export.Allow) != 2 || !filepath.IsAbs(export.Path) {
+		t.Fatalf("Unexpected export: %v", export)
+	}
+	if export, _ = ParseExport("backups=" + dir); export.Mode != ReadWrite || len(export.Allow) != 0 {
+		t.Fatalf("Expected a read-write export for anyone, got %v", export)
+	}
+	for _, spec := range []string{dir, "=" + dir, "a/b=" + dir, "backups=" + dir + ",rx", "backups=" + filepath.Join(dir, "missing")} {
+		if _, err = ParseExport(spec); err == nil {
+			t.Fatalf("Expected %s to be rejected", spec)
+		}
+	}
+}
+
+func TestRemoteExports(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "mirror-remote-test")
+	defer os.RemoveAll(dir)
+	exports := make(Exports)
+	for _, spec := range []string{"rw=%s/rw", "ro=%s/ro,ro,alice", "wo=%s/wo,wo"} {
+		os.Mkdir(filepath.Join(dir, spec[:2]), 0755)
+		export, err := ParseExport(fmt.Sprintf(spec, dir))
+		if err != nil {
+			t.Fatalf("Did not expect err: %v", err)
+		}
+		exports[export.Name] = export
+	}
+	ioutil.WriteFile(filepath.Join(dir, "ro", "foo.txt"), []byte("foo"), 0644)
+	alice := testDaemon(&RemoteFileSystem{Exports: exports, Peer: []string{"alice"}})
+	bob := testDaemon(&RemoteFileSystem{Exports: exports, Peer: []string{"bob"}})
+
+	file := filesystem.File{FileName: "bar.txt", FilePath: "/rw/sub/bar.txt"}
+	if err := alice.Write(file, []byte("bar"), 0644); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "rw", "sub", "bar.txt")); string(data) != "bar" {
+		t.Fatalf("Expected bar.txt to be written to the export, got %s", data)
+	}
+	if written, err := alice.ReadFile("/rw/sub/bar.txt"); err != nil || written.Path() != "/rw/sub/bar.txt" {
+		t.Fatalf("Expected bar.txt to be read by its path in the export, got %v: %v", written.Path(), err)
+	}
+	root, _ := alice.ReadFile("/rw")
+	listing, err := alice.FileMap(root)
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	for _, f := range listing {
+		if !strings.HasPrefix(f.Path(), "/rw/") {
+			t.Fatalf("Expected listed files to be in the export, got %s", f.Path())
+		}
+	}
+
+	if data, err := alice.Read(filesystem.File{FilePath: "/ro/foo.txt"}); err != nil || string(data) != "foo" {
+		t.Fatalf("Expected alice to read from the read-only export, got %s: %v", data, err)
+	}
+	_, bobRead := bob.Read(filesystem.File{FilePath: "/ro/foo.txt"})
+	_, woRead := alice.Read(filesystem.File{FilePath: "/wo/foo.txt"})
+	_, woHash := alice.Hash(filesystem.File{FilePath: "/wo/foo.txt"}, filesystem.MD5)
+	_, woSignature := alice.Signature(filesystem.File{FilePath: "/wo/foo.txt"}, 16)
+	for _, err := range []error{
+		alice.Write(filesystem.File{FilePath: "/ro/new.txt"}, []byte("new"), 0644),
+		alice.Delete("/ro/foo.txt"),
+		bobRead,
+		woRead,
+		woHash,
+		woSignature,
+		alice.Write(filesystem.File{FilePath: "/missing/foo.txt"}, []byte("new"), 0644),
+		alice.Write(filesystem.File{FilePath: "/rw/../ro/foo.txt"}, []byte("new"), 0644),
+		alice.Delete("/rw"),
+	} {
+		if err == nil || !strings.Contains(err.Error(), "Access denied") {
+			t.Fatalf("Expected access to be denied, got %v", err)
+		}
+	}
+	if err := bob.Write(filesystem.File{FilePath: "/wo/drop.txt"}, []byte("drop"), 0644); err != nil {
+		t.Fatalf("Expected bob to write to the write-only export: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "ro", "foo.txt")); string(data) != "foo" {
+		t.Fatalf("Expected the read-only export to be untouched, got %s", data)
+	}
+}
+
+func TestLoadACL(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "mirror-remote-test")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "acl")
+
+	ioutil.WriteFile(path, []byte("# name rights\n\nalice read,write,delete\nbackup.example.com write # no reading back\n* read\n"), 0644)
+	acl, err := LoadACL(path)
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if len(acl) != 3 || !acl["alice"][Delete] || !acl["backup.example.com"][List] || acl["backup.example.com"][Read] {
+		t.Fatalf("Unexpected ACL: %v", acl)
+	}
+	if !acl.allows([]string{"bob"}, List) || !acl.allows([]string{"bob"}, Read) || acl.allows([]string{"bob"}, Write) {
+		t.Fatalf("Expected anyone to have read access only")
+	}
+	if !acl.allows([]string{"CN=alice", "alice"}, Delete) {
+		t.Fatalf("Expected alice to be found by any of her names")
+	}
+
+	for _, content := range []string{"alice\n", "alice read write\n", "alice execute\n", "alice read\nalice write\n"} {
+		ioutil.WriteFile(path, []byte(content), 0644)
+		if _, err = LoadACL(path); err == nil {
+			t.Fatalf("Expected %q to be rejected", content)
+		}
+	}
+}
+
+func TestLoadDaemonConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "mirror-remote-test")
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "backups"), 0755)
+	path := filepath.Join(dir, "daemon.hcl")
+
+	ioutil.WriteFile(path, []byte(fmt.Sprintf(`
+listen = ["127.0.0.1:8123", "[::1]:8124"]
+
+export "backups" {
+  path  = "%[1]s/backups"
+  mode  = "wo"
+  allow = ["backup.example.com"]
+}
+
+client "alice" {
+  rights = ["read", "write"]
+}
+
+log {
+  file = "%[1]s/daemon.log"
+}
+
+limits {
+  max_connections = 4
+  idle_timeout    = "5m"
+}
+
+hooks {
+  on_connect = "true"
+}
+`, dir)), 0644)
+	config, err := LoadDaemonConfig(path)
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	daemon, err := config.Daemon()
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if len(daemon.Listen) != 2 || daemon.MaxConnections != 4 || daemon.IdleTimeout != 5*time.Minute || daemon.FileSystem.Hooks.OnConnect != "true" {
+		t.Fatalf("Unexpected daemon: %+v", daemon)
+	}
+	export := daemon.FileSystem.Exports["backups"]
+	if export == nil || export.Mode != WriteOnly || len(export.Allow) != 1 {
+		t.Fatalf("Unexpected export: %v", export)
+	}
+	if rights := daemon.FileSystem.ACL["alice"]; !rights[Read] || !rights[Write] || rights[Delete] {
+		t.Fatalf("Unexpected rights for alice: %v", rights)
+	}
+
+	ioutil.WriteFile(path, []byte("hooks {\n  on_start = \"true\"\n}\n"), 0644)
+	if _, err = LoadDaemonConfig(path); err == nil || !strings.Contains(err.Error(), "on_start") {
+		t.Fatalf("Expected an unknown setting to be rejected, got %v", err)
+	}
+
+	ioutil.WriteFile(path, []byte(fmt.Sprintf(`
+listen = ["8123"]
+root   = "%[1]s/missing"
+export "backups" { path = "%[1]s/backups", mode = "rx" }
+limits { idle_timeout = "soon" }
+`, dir)), 0644)
+	if config, err = LoadDaemonConfig(path); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	_, err = config.Daemon()
+	if err == nil {
+		t.Fatalf("Expected an invalid config to be rejected")
+	}
+	for _, problem := range []string{"listen", "root", "export backups", "idle_timeout"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Fatalf("Expected a problem with %s to be reported, got %v", problem, err)
+		}
+	}
+
+	// Nested exports, which would make the export a path belongs to ambiguous
+	ioutil.WriteFile(path, []byte(fmt.Sprintf(`
+export "all" { path = "%[1]s" }
+export "backups" { path = "%[1]s/backups" }
+`, dir)), 0644)
+	if config, err = LoadDaemonConfig(path); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if _, err = config.Daemon(); err == nil || !strings.Contains(err.Error(), "overlaps") {
+		t.Fatalf("Expected nested exports to be rejected, got %v", err)
+	}
+
+	// Siblings sharing a prefix don't overlap
+	os.Mkdir(filepath.Join(dir, "backups2"), 0755)
+	backups, _ := ParseExport("backups=" + filepath.Join(dir, "backups"))
+	backups2, _ := ParseExport("backups2=" + filepath.Join(dir, "backups2"))
+	if other := (Exports{"backups": backups}).Overlapping(backups2); other != nil {
+		t.Fatalf("Did not expect %s to overlap %s", backups2.Path, other.Path)
+	}
+}
+
+func TestRemoteHooks(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "mirror-remote-test")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "foo.txt"), []byte("foo"), 0644)
+
+	rejected := testDaemon(&RemoteFileSystem{Hooks: Hooks{OnConnect: "exit 1"}})
+	if _, err := rejected.Read(filesystem.File{FilePath: filepath.Join(dir, "foo.txt")}); err == nil {
+		t.Fatalf("Expected the client to be disconnected when on_connect fails")
+	}
+	accepted := testDaemon(&RemoteFileSystem{Hooks: Hooks{OnConnect: "exit 0"}})
+	if data, err := accepted.Read(filesystem.File{FilePath: filepath.Join(dir, "foo.txt")}); err != nil || string(data) != "foo" {
+		t.Fatalf("Expected foo.txt to be read, got %s: %v", data, err)
+	}
+}
+
+// An RPC service whose calls finish when told to
+type slowService struct {
+	started chan bool
+	finish  chan bool
+}
+
+func (s *slowService) Wait(req int, res *int) error {
+	s.started <- true
+	<-s.finish
+	*res = req
+	return nil
+}
+
+func TestServerCodec_Drain(t *testing.T) {
+	client, server := net.Pipe()
+	service := &slowService{started: make(chan bool), finish: make(chan bool)}
+	srv := rpc.NewServer()
+	srv.RegisterName("Slow", service)
+	codec := newServerCodec(server)
+	go srv.ServeCodec(codec)
+	rpcClient := rpc.NewClient(client)
+
+	call := rpcClient.Go("Slow.Wait", 42, new(int), nil)
+	<-service.started
+	codec.drain()
+
+	close(service.finish)
+	<-call.Done
+	if call.Error != nil || *call.Reply.(*int) != 42 {
+		t.Fatalf("Expected the call in progress to finish, got %v", call.Error)
+	}
+	var res int
+	if err := rpcClient.Call("Slow.Wait", 1, &res); err == nil {
+		t.Fatalf("Expected the connection to be closed once idle")
+	}
+}
+
+func TestDaemonShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	daemon := new(Daemon)
+	errs := make(chan error)
+	go func() { errs <- daemon.Serve(listener) }()
+	time.Sleep(10 * time.Millisecond)
+
+	if err = daemon.Shutdown(); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if err = <-errs; err != ErrDaemonClosed {
+		t.Fatalf("Expected the daemon to stop serving, got %v", err)
+	}
+	if _, err = net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Fatalf("Expected the daemon to stop accepting clients")
+	}
+}
+
+// A listener whose Accept fails with each of errs in turn
+type failingListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if len(l.errs) == 0 {
+		return l.Listener.Accept()
+	}
+	err := l.errs[0]
+	l.errs = l.errs[1:]
+	return nil, err
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func TestDaemonServe_AcceptErrors(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	fatal := fmt.Errorf("listener broken")
+	listener := &failingListener{Listener: tcp, errs: []error{temporaryError{}, temporaryError{}, fatal}}
+	daemon := new(Daemon)
+	defer daemon.Shutdown()
+
+	if err = daemon.Serve(listener); err != fatal {
+		t.Fatalf("Expected temporary errors to be retried until a fatal one, got %v", err)
+	}
+	if len(listener.errs) != 0 {
+		t.Fatalf("Expected every error to be seen, %d left", len(listener.errs))
+	}
+}
+
+func TestRemoteACL(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "mirror-remote-test")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "foo.txt"), []byte("foo"), 0644)
+	acl := ACL{
+		"alice":              {List: true, Read: true, Write: true, Delete: true},
+		"backup.example.com": {Write: true},
+	}
+	alice := testDaemon(&RemoteFileSystem{ACL: acl, Peer: []string{"alice", "CN=alice"}})
+	backup := testDaemon(&RemoteFileSystem{ACL: acl, Peer: []string{"backup", "CN=backup", "backup.example.com"}})
+	anonymous := testDaemon(&RemoteFileSystem{ACL: acl})
+
+	bar := filepath.Join(dir, "bar.txt")
+	if err := backup.Write(filesystem.File{FilePath: bar}, []byte("bar"), 0644); err != nil {
+		t.Fatalf("Expected backup to write by its DNS name: %v", err)
+	}
+	if data, err := alice.Read(filesystem.File{FilePath: bar}); err != nil || string(data) != "bar" {
+		t.Fatalf("Expected alice to read bar.txt, got %s: %v", data, err)
+	}
+	_, backupRead := backup.Read(filesystem.File{FilePath: bar})
+	_, anonymousRead := anonymous.ReadFile(filepath.Join(dir, "foo.txt"))
+	for _, err := range []error{
+		backupRead,
+		backup.Delete(bar),
+		anonymousRead,
+		anonymous.Write(filesystem.File{FilePath: bar}, []byte("new"), 0644),
+	} {
+		if err == nil || !strings.Contains(err.Error(), "Access denied") {
+			t.Fatalf("Expected access to be denied, got %v", err)
+		}
+	}
+	if err := alice.Delete(bar); err != nil {
+		t.Fatalf("Expected alice to delete bar.txt: %v", err)
+	}
+}
+
+func TestRemoteHash(t *testing.T) {
+	fs := testRemoteFileSystem()
+	dir, _ := ioutil.TempDir("", "mirror-hash")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+	ioutil.WriteFile(path, []byte("hello\ngo\n"), 0644)
+
+	hash, err := fs.Hash(filesystem.File{FileName: "file", FilePath: path}, filesystem.MD5)
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if hash != "4738662f38bc4f828efb2e55a4705c1c" {
+		t.Fatalf("Unexpected hash: %s", hash)
+	}
+
+	if _, err = fs.Hash(filesystem.File{FilePath: path}, "crc32"); err == nil {
+		t.Fatalf("Expected err for an unsupported algorithm")
+	}
+}
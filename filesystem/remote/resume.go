@@ -0,0 +1,115 @@
+package remote
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mefellows/mirror/filesystem"
+	"github.com/mefellows/mirror/filesystem/delta"
+	"github.com/mefellows/mirror/filesystem/fs"
+)
+
+// Remote RPC Types
+type ResumeRequest struct {
+	File      filesystem.File
+	Perm      os.FileMode
+	Offset    int64
+	Algorithm string
+}
+
+type CommitRequest struct {
+	Handle uint64
+	Sum    string
+}
+
+func (f RemoteFileSystem) RemotePartialSignature(req *SignatureRequest, res *SignatureResponse) error {
+	if res.Error = f.authorize(List, false, &req.File.FilePath); res.Error != nil {
+		return res.Error
+	}
+	if res.Error = f.confine(true, fs.PartialPath(req.File)); res.Error != nil {
+		return res.Error
+	}
+	fsys := fs.StdFileSystem{}
+	res.Signature, res.Error = fsys.PartialSignature(req.File, req.BlockSize)
+	if res.Error == nil {
+		res.Success = true
+	}
+	return res.Error
+}
+
+// Reopens the partial File left by an interrupted transfer on the daemon,
+// for the client to write the rest of it a chunk at a time
+func (f RemoteFileSystem) RemoteResume(req *ResumeRequest, res *StreamResponse) error {
+	if res.Error = f.authorize(Write, false, &req.File.FilePath); res.Error != nil {
+		return res.Error
+	}
+	if res.Error = f.confine(true, fs.PartialPath(req.File)); res.Error != nil {
+		return res.Error
+	}
+	fsys := fs.StdFileSystem{}
+	w, err := fsys.Resume(req.File, req.Perm, req.Offset, req.Algorithm)
+	if err != nil {
+		res.Error = err
+		return res.Error
+	}
+	res.Handle = f.streams.add(w)
+	res.Success = true
+	return nil
+}
+
+func (f RemoteFileSystem) RemoteCommit(req *CommitRequest, res *RemoteResponse) error {
+	stream, err := f.streams.remove(req.Handle)
+	if err != nil {
+		res.Error = err
+		return res.Error
+	}
+	w, ok := stream.(filesystem.ResumeWriter)
+	if !ok {
+		res.Error = fmt.Errorf("Stream %d is not a resumed File", req.Handle)
+		return res.Error
+	}
+	res.Error = w.Commit(req.Sum)
+	if res.Error == nil {
+		res.Success = true
+	}
+	return res.Error
+}
+
+func (f RemoteFileSystem) PartialSignature(file filesystem.File, blockSize int) (*delta.Signature, error) {
+	rpcargs := &SignatureRequest{File: file, BlockSize: blockSize}
+	var reply SignatureResponse
+	err := f.client.Call("RemoteFileSystem.RemotePartialSignature", rpcargs, &reply)
+	return reply.Signature, err
+}
+
+func (f RemoteFileSystem) Resume(file filesystem.File, perm os.FileMode, offset int64, algorithm string) (filesystem.ResumeWriter, error) {
+	rpcargs := &ResumeRequest{File: file, Perm: perm, Offset: offset, Algorithm: algorithm}
+	var reply StreamResponse
+	if err := f.client.Call("RemoteFileSystem.RemoteResume", rpcargs, &reply); err != nil {
+		return nil, err
+	}
+	return &remoteResumeWriter{remoteWriter{client: f, handle: reply.Handle, buf: make([]byte, 0, StreamChunkSize)}}, nil
+}
+
+// Client side of a resumed File. Aborting it keeps the partial File on the
+// daemon, ready for the next attempt.
+type remoteResumeWriter struct {
+	remoteWriter
+}
+
+func (w *remoteResumeWriter) Commit(sum string) error {
+	if err := w.flush(); err != nil {
+		w.Abort()
+		return err
+	}
+	rpcargs := &CommitRequest{Handle: w.handle, Sum: sum}
+	var reply RemoteResponse
+	return w.client.client.Call("RemoteFileSystem.RemoteCommit", rpcargs, &reply)
+}
+
+// Abort sends anything still buffered before closing the stream, so that
+// it can be resumed from
+func (w *remoteResumeWriter) Abort() error {
+	w.flush()
+	return w.remoteWriter.Abort()
+}
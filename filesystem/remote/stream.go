@@ -0,0 +1,317 @@
+package remote
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/mefellows/mirror/filesystem"
+	"github.com/mefellows/mirror/filesystem/fs"
+)
+
+// The maximum number of bytes sent over the RPC connection in a single call.
+//
+// Files are streamed as a sequence of chunks so that neither side needs to
+// hold an entire file in memory.
+const StreamChunkSize = 1024 * 1024
+
+// Streams currently open on the daemon, keyed by the handle
+// given to the client. Each connection has its own, so that a client
+// can only use the streams it opened.
+type streamTable struct {
+	sync.Mutex
+	next    uint64
+	streams map[uint64]interface{}
+}
+
+func newStreamTable() *streamTable {
+	return &streamTable{streams: make(map[uint64]interface{})}
+}
+
+func (t *streamTable) add(stream interface{}) uint64 {
+	t.Lock()
+	defer t.Unlock()
+	t.next++
+	t.streams[t.next] = stream
+	return t.next
+}
+
+func (t *streamTable) get(handle uint64) (interface{}, error) {
+	t.Lock()
+	defer t.Unlock()
+	stream, ok := t.streams[handle]
+	if !ok {
+		return nil, fmt.Errorf("Unknown stream handle: %d", handle)
+	}
+	return stream, nil
+}
+
+// Abort every stream left open, when the client goes away
+func (t *streamTable) abortAll() {
+	t.Lock()
+	defer t.Unlock()
+	for handle, stream := range t.streams {
+		abortStream(stream)
+		delete(t.streams, handle)
+	}
+}
+
+func (t *streamTable) remove(handle uint64) (interface{}, error) {
+	t.Lock()
+	defer t.Unlock()
+	stream, ok := t.streams[handle]
+	if !ok {
+		return nil, fmt.Errorf("Unknown stream handle: %d", handle)
+	}
+	delete(t.streams, handle)
+	return stream, nil
+}
+
+// Remote RPC Types
+type OpenRequest struct {
+	File filesystem.File
+}
+
+type CreateRequest struct {
+	File filesystem.File
+	Perm os.FileMode
+}
+
+type StreamResponse struct {
+	RemoteResponse
+	Handle uint64
+}
+
+type ReadChunkRequest struct {
+	Handle uint64
+	Size   int
+}
+
+type ReadChunkResponse struct {
+	RemoteResponse
+	Data []byte
+	EOF  bool
+}
+
+type WriteChunkRequest struct {
+	Handle uint64
+	Data   []byte
+}
+
+type CloseRequest struct {
+	Handle uint64
+}
+
+func (f RemoteFileSystem) RemoteOpen(req *OpenRequest, res *StreamResponse) error {
+	if res.Error = f.authorize(Read, true, &req.File.FilePath); res.Error != nil {
+		return res.Error
+	}
+	fsys := fs.StdFileSystem{}
+	r, err := fsys.Open(req.File)
+	if err != nil {
+		res.Error = err
+		return res.Error
+	}
+	res.Handle = f.streams.add(r)
+	res.Success = true
+	return nil
+}
+
+func (f RemoteFileSystem) RemoteCreate(req *CreateRequest, res *StreamResponse) error {
+	if res.Error = f.authorize(Write, false, &req.File.FilePath); res.Error != nil {
+		return res.Error
+	}
+	fsys := fs.StdFileSystem{}
+	w, err := fsys.Create(req.File, req.Perm)
+	if err != nil {
+		res.Error = err
+		return res.Error
+	}
+	res.Handle = f.streams.add(w)
+	res.Success = true
+	return nil
+}
+
+func (f RemoteFileSystem) RemoteReadChunk(req *ReadChunkRequest, res *ReadChunkResponse) error {
+	stream, err := f.streams.get(req.Handle)
+	if err != nil {
+		res.Error = err
+		return res.Error
+	}
+	r, ok := stream.(io.Reader)
+	if !ok {
+		res.Error = fmt.Errorf("Stream %d is not open for reading", req.Handle)
+		return res.Error
+	}
+	size := req.Size
+	if size <= 0 || size > StreamChunkSize {
+		size = StreamChunkSize
+	}
+	res.Data = make([]byte, size)
+	n, err := io.ReadFull(r, res.Data)
+	res.Data = res.Data[:n]
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		res.EOF = true
+		err = nil
+	}
+	res.Error = err
+	if res.Error == nil {
+		res.Success = true
+	}
+	return res.Error
+}
+
+func (f RemoteFileSystem) RemoteWriteChunk(req *WriteChunkRequest, res *RemoteResponse) error {
+	stream, err := f.streams.get(req.Handle)
+	if err != nil {
+		res.Error = err
+		return res.Error
+	}
+	w, ok := stream.(io.Writer)
+	if !ok {
+		res.Error = fmt.Errorf("Stream %d is not open for writing", req.Handle)
+		return res.Error
+	}
+	_, res.Error = w.Write(req.Data)
+	if res.Error == nil {
+		res.Success = true
+	}
+	return res.Error
+}
+
+func (f RemoteFileSystem) RemoteClose(req *CloseRequest, res *RemoteResponse) error {
+	stream, err := f.streams.remove(req.Handle)
+	if err != nil {
+		res.Error = err
+		return res.Error
+	}
+	if c, ok := stream.(io.Closer); ok {
+		res.Error = c.Close()
+	}
+	if res.Error == nil {
+		res.Success = true
+	}
+	return res.Error
+}
+
+// Discard a stream without committing it, for streams that support it
+func (f RemoteFileSystem) RemoteAbort(req *CloseRequest, res *RemoteResponse) error {
+	stream, err := f.streams.remove(req.Handle)
+	if err != nil {
+		res.Error = err
+		return res.Error
+	}
+	abortStream(stream)
+	res.Success = true
+	return nil
+}
+
+func abortStream(stream interface{}) {
+	if a, ok := stream.(interface {
+		Abort() error
+	}); ok {
+		a.Abort()
+	} else if c, ok := stream.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+func (f RemoteFileSystem) Open(file filesystem.File) (io.ReadCloser, error) {
+	rpcargs := &OpenRequest{File: file}
+	var reply StreamResponse
+	if err := f.client.Call("RemoteFileSystem.RemoteOpen", rpcargs, &reply); err != nil {
+		return nil, err
+	}
+	return &remoteReader{client: f, handle: reply.Handle}, nil
+}
+
+func (f RemoteFileSystem) Create(file filesystem.File, perm os.FileMode) (io.WriteCloser, error) {
+	rpcargs := &CreateRequest{File: file, Perm: perm}
+	var reply StreamResponse
+	if err := f.client.Call("RemoteFileSystem.RemoteCreate", rpcargs, &reply); err != nil {
+		return nil, err
+	}
+	return &remoteWriter{client: f, handle: reply.Handle, buf: make([]byte, 0, StreamChunkSize)}, nil
+}
+
+// Client side of a remote read stream, fetching a chunk at a time from the daemon
+type remoteReader struct {
+	client RemoteFileSystem
+	handle uint64
+	buf    []byte
+	eof    bool
+}
+
+func (r *remoteReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		rpcargs := &ReadChunkRequest{Handle: r.handle, Size: StreamChunkSize}
+		var reply ReadChunkResponse
+		if err := r.client.client.Call("RemoteFileSystem.RemoteReadChunk", rpcargs, &reply); err != nil {
+			return 0, err
+		}
+		r.buf = reply.Data
+		r.eof = reply.EOF
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *remoteReader) Close() error {
+	var reply RemoteResponse
+	return r.client.client.Call("RemoteFileSystem.RemoteClose", &CloseRequest{Handle: r.handle}, &reply)
+}
+
+// Client side of a remote write stream, buffering writes into chunks
+// before sending them to the daemon
+type remoteWriter struct {
+	client RemoteFileSystem
+	handle uint64
+	buf    []byte
+}
+
+func (w *remoteWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *remoteWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	rpcargs := &WriteChunkRequest{Handle: w.handle, Data: w.buf}
+	var reply RemoteResponse
+	err := w.client.client.Call("RemoteFileSystem.RemoteWriteChunk", rpcargs, &reply)
+	w.buf = w.buf[:0]
+	return err
+}
+
+// Abort discards the stream on the daemon, leaving the File as it was
+func (w *remoteWriter) Abort() error {
+	var reply RemoteResponse
+	return w.client.client.Call("RemoteFileSystem.RemoteAbort", &CloseRequest{Handle: w.handle}, &reply)
+}
+
+func (w *remoteWriter) Close() error {
+	err := w.flush()
+	var reply RemoteResponse
+	if cerr := w.client.client.Call("RemoteFileSystem.RemoteClose", &CloseRequest{Handle: w.handle}, &reply); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,50 @@
+package s3
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/goamz/goamz/aws"
+)
+
+// Where to find an S3-compatible store other than AWS, such as MinIO or Ceph
+type EndpointConfig struct {
+	URL           string // e.g. http://localhost:9000. Overrides the endpoint given by the S3 URL; http:// endpoints are not encrypted
+	PathStyle     bool   // Address buckets by path (http://host/bucket/key), rather than as a subdomain (http://bucket.host/key)
+	NoCredentials bool   // Don't load any credentials, for local endpoints that don't authenticate requests. Requests are still signed, with an empty key
+}
+
+// Applied to every S3FileSystem created
+var Endpoint EndpointConfig
+
+// Check that an endpoint URL is usable
+func (e EndpointConfig) Validate() error {
+	if e.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid S3 endpoint '%s': expected http://host[:port] or https://host[:port]", e.URL)
+	}
+	return nil
+}
+
+// The goamz Region used to reach the bucket. AWS regions are looked up by
+// name; any other endpoint is described by a Region of its own.
+func (c *S3Config) awsRegion() aws.Region {
+	if c.endpoint == "" {
+		return aws.Regions[c.region]
+	}
+	endpoint := strings.TrimSuffix(c.endpoint, "/")
+	region := aws.Region{Name: c.region, S3Endpoint: endpoint, S3LocationConstraint: true}
+	if !c.pathStyle {
+		if u, err := url.Parse(endpoint); err == nil {
+			region.S3BucketEndpoint = u.Scheme + "://${bucket}." + u.Host
+		}
+	}
+	return region
+}
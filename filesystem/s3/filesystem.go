@@ -6,10 +6,13 @@ import (
 	"github.com/goamz/goamz/s3"
 	"github.com/mefellows/mirror/filesystem"
 	"github.com/mefellows/mirror/mirror"
+	"io"
 	"mime"
+	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
@@ -49,9 +52,12 @@ func NewS3FileSystem(url string) (filesystem.FileSystem, error) {
 }
 
 type S3Config struct {
-	bucket  string
-	region  string
-	baseURL string // The base component of the S3 URL e.g. s3://s3.amazonaws.com/mybucket/. This component should be removed in any PUTs
+	bucket    string
+	region    string
+	baseURL   string // The base component of the S3 URL e.g. s3://s3.amazonaws.com/mybucket/. This component should be removed in any PUTs
+	root      string // The bucket component of the path in a path-style URL e.g. /mybucket. Removed from a File's path to give its key
+	endpoint  string // The URL of an S3-compatible endpoint other than AWS e.g. https://minio.local:9000
+	pathStyle bool   // Address the bucket by path at the endpoint, rather than by subdomain
 }
 
 // Create a new S3FileSystem object. Requires an S3 URL to configure
@@ -64,8 +70,13 @@ func New(url string) (*S3FileSystem, error) {
 	if err != nil {
 		return nil, err
 	}
-	region := aws.Regions[config.region]
-	service := s3.New(*auth, region)
+	if Endpoint.URL != "" {
+		config.endpoint = Endpoint.URL
+	}
+	if Endpoint.PathStyle {
+		config.pathStyle = true
+	}
+	service := s3.New(*auth, config.awsRegion())
 
 	s3fs := &S3FileSystem{
 		auth:      auth,
@@ -79,6 +90,10 @@ func New(url string) (*S3FileSystem, error) {
 
 // Get Authentication details from environment
 var auth = func() (*aws.Auth, error) {
+	if Endpoint.NoCredentials {
+		return &aws.Auth{}, nil
+	}
+
 	// Check $HOME/.aws/credentials first
 	auth, err := aws.SharedAuth()
 	if err == nil {
@@ -93,14 +108,21 @@ var auth = func() (*aws.Auth, error) {
 	return &auth, nil
 }
 
-// Extract the bucket name and region from an s3:// URL
+// Extract the bucket name and region from an s3:// URL.
+//
+// Any host other than AWS is treated as an S3-compatible endpoint, addressed
+// by path over HTTPS e.g. s3://minio.local:9000/mybucket/foo
 func config(url string) (*S3Config, error) {
 	var virtualhostMatch = regexp.MustCompile(`^(s3:\/\/([a-zA-Z-_\.0-9]+)\.s3\.amazonaws\.com)`)
 	var virtualhostWithRegionMatch = regexp.MustCompile(`^(s3:\/\/([a-zA-Z-_\.0-9]+)\.s3-([a-zA-Z-_\.0-9]+)\.amazonaws\.com)`)
 	var pathMatch = regexp.MustCompile(`^(s3:\/\/s3\.amazonaws\.com\/([a-zA-Z-_\.0-9]+))\/`)
 	var pathWithRegionMatch = regexp.MustCompile(`^(s3:\/\/s3-([a-zA-Z-_\.0-9]+)\.amazonaws\.com\/([a-zA-Z-_\.0-9]+))\/`)
+	var customMatch = regexp.MustCompile(`^(s3:\/\/([a-zA-Z-_\.0-9]+(:[0-9]+)?)\/([a-zA-Z-_\.0-9]+))\/`)
 	var bucket string
 	var baseURL string
+	var root string
+	var endpoint string
+	pathStyle := false
 	region := "us-east-1" // Default
 
 	switch {
@@ -117,53 +139,369 @@ func config(url string) (*S3Config, error) {
 		matches := pathMatch.FindStringSubmatch(url)
 		baseURL = matches[1]
 		bucket = matches[2]
+		root = "/" + bucket
+		pathStyle = true
 	case pathWithRegionMatch.MatchString(url):
 		matches := pathWithRegionMatch.FindStringSubmatch(url)
 		baseURL = matches[1]
 		region = matches[2]
 		bucket = matches[3]
+		root = "/" + bucket
+		pathStyle = true
+	case customMatch.MatchString(url) && !strings.Contains(customMatch.FindStringSubmatch(url)[2], "amazonaws.com"):
+		matches := customMatch.FindStringSubmatch(url)
+		baseURL = matches[1]
+		endpoint = "https://" + matches[2]
+		bucket = matches[4]
+		root = "/" + bucket
+		pathStyle = true
 	default:
 		return nil, errors.New("Invalid S3 URL provided")
 	}
 
 	return &S3Config{
-		bucket:  bucket,
-		region:  region,
-		baseURL: baseURL,
+		bucket:    bucket,
+		region:    region,
+		baseURL:   baseURL,
+		root:      root,
+		endpoint:  endpoint,
+		pathStyle: pathStyle,
 	}, nil
 }
 
+// The number of keys requested in each page of a listing
+var listPageSize = 1000
+
+// Objects are addressed by key, which is the File's path without the leading
+// slash. There are no real directories: a directory is a key prefix ending in
+// a slash, and is represented by an empty marker object when created with MkDir.
+func (fs S3FileSystem) key(file filesystem.File) string {
+	return fs.pathKey(file.Path())
+}
+
+func (fs S3FileSystem) pathKey(path string) string {
+	path = strings.TrimPrefix(path, fs.config.root)
+	return strings.TrimPrefix(path, "/")
+}
+
+// The File for a key. Directories have no size or modification time.
+func (fs S3FileSystem) keyFile(key string, size int64, modTime time.Time) filesystem.File {
+	file := filesystem.File{
+		FileName:    filepath.Base(strings.TrimSuffix(key, "/")),
+		FilePath:    fs.config.root + "/" + strings.TrimSuffix(key, "/"),
+		FileSize:    size,
+		FileModTime: modTime,
+		FileMode:    0644,
+	}
+	if key == "" || strings.HasSuffix(key, "/") {
+		file.FileMode = os.ModeDir | 0755
+	}
+	return file
+}
+
+func (fs S3FileSystem) objectFile(obj s3.Key) filesystem.File {
+	modTime, _ := time.Parse(time.RFC3339, obj.LastModified)
+	return fs.keyFile(obj.Key, obj.Size, modTime)
+}
+
+// The key prefix under which the contents of a directory are stored
+func dirPrefix(key string) string {
+	if key == "" || strings.HasSuffix(key, "/") {
+		return key
+	}
+	return key + "/"
+}
+
+// Call fn with each page of a listing, following continuation markers
+// until the listing is complete
+func (fs S3FileSystem) list(prefix string, delim string, fn func(*s3.ListResp)) error {
+	marker := ""
+	for {
+		res, err := fs.bucket.List(prefix, delim, marker, listPageSize)
+		if err != nil {
+			return err
+		}
+		fn(res)
+		if !res.IsTruncated {
+			return nil
+		}
+
+		// NextMarker is only returned when a delimiter is given
+		marker = res.NextMarker
+		if marker == "" && len(res.Contents) > 0 {
+			marker = res.Contents[len(res.Contents)-1].Key
+		}
+		if marker == "" {
+			return nil
+		}
+	}
+}
+
 func (fs S3FileSystem) Dir(dir string) ([]filesystem.File, error) {
-	return nil, errors.New("Function not yet implemented")
+	prefix := dirPrefix(fs.pathKey(dir))
+	files := make([]filesystem.File, 0)
+	err := fs.list(prefix, "/", func(res *s3.ListResp) {
+		for _, obj := range res.Contents {
+			if obj.Key != prefix {
+				files = append(files, fs.objectFile(obj))
+			}
+		}
+		for _, p := range res.CommonPrefixes {
+			files = append(files, fs.keyFile(p, 0, time.Time{}))
+		}
+	})
+	return files, err
 }
 
 func (fs S3FileSystem) Read(f filesystem.File) ([]byte, error) {
-	return nil, errors.New("Function not yet implemented")
+	return fs.bucket.Get(fs.key(f))
 }
 
 func (fs S3FileSystem) Write(file filesystem.File, data []byte, perm os.FileMode) error {
-	fileName := strings.TrimPrefix(file.Name(), fs.config.baseURL)
-	return fs.bucket.Put(fileName, data, mimeType(file), s3.BucketOwnerFull, s3.Options{})
+	if int64(len(data)) <= Transfer.PartSize {
+		return fs.bucket.Put(fs.key(file), data, mimeType(file), s3.BucketOwnerFull, xattrsOptions(file))
+	}
+	file.FileSize = int64(len(data))
+	w, err := fs.createMultipart(file)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Open reads objects larger than a single part a range at a time
+func (fs S3FileSystem) Open(file filesystem.File) (io.ReadCloser, error) {
+	if file.Size() <= Transfer.PartSize {
+		return fs.bucket.GetReader(fs.key(file))
+	}
+	return &rangeReader{bucket: fs.bucket, key: fs.key(file), size: file.Size()}, nil
+}
+
+// Hash uses the ETag of the object as its MD5, where possible. The ETag of
+// an object uploaded in multiple parts is not an MD5 of its contents, so
+// it must be downloaded and hashed instead.
+func (fs S3FileSystem) Hash(file filesystem.File, algorithm string) (string, error) {
+	if algorithm == filesystem.MD5 {
+		res, err := fs.bucket.Head(fs.key(file), nil)
+		if err != nil {
+			return "", err
+		}
+		res.Body.Close()
+		etag := strings.Trim(res.Header.Get("ETag"), `"`)
+		if etag != "" && !strings.Contains(etag, "-") {
+			return etag, nil
+		}
+	}
+	return filesystem.StreamHash(fs, file, algorithm)
+}
+
+// Create streams the written data directly into a PUT request, or a
+// multipart upload for Files larger than a single part.
+// The File's size must be known up front, as S3 requires a Content-Length.
+func (fs S3FileSystem) Create(file filesystem.File, perm os.FileMode) (io.WriteCloser, error) {
+	if file.Size() > Transfer.PartSize {
+		return fs.createMultipart(file)
+	}
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := fs.bucket.PutReader(fs.key(file), r, file.Size(), mimeType(file), s3.BucketOwnerFull, xattrsOptions(file))
+		r.CloseWithError(err)
+		done <- err
+	}()
+	return &s3Writer{PipeWriter: w, done: done}, nil
+}
+
+// Writer end of a streaming PUT. Close blocks until the upload has completed.
+type s3Writer struct {
+	*io.PipeWriter
+	done chan error
+}
+
+func (w *s3Writer) Close() error {
+	w.PipeWriter.Close()
+	return <-w.done
+}
+
+// Abort fails the PUT, so the object is never replaced
+func (w *s3Writer) Abort() error {
+	w.PipeWriter.CloseWithError(errors.New("Upload aborted"))
+	<-w.done
+	return nil
 }
 
+// ReadFile looks up an object by key, falling back to a listing to find out
+// if the key is a directory prefix
 func (fs S3FileSystem) ReadFile(file string) (filesystem.File, error) {
-	return filesystem.File{}, errors.New("Function not yet implemented")
+	key := fs.pathKey(file)
+	if key == "" {
+		return fs.keyFile("", 0, time.Time{}), nil
+	}
+
+	if !strings.HasSuffix(key, "/") {
+		res, err := fs.bucket.Head(key, nil)
+		if err == nil {
+			res.Body.Close()
+			modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+			f := fs.keyFile(key, res.ContentLength, modTime)
+			if Xattrs {
+				f.FileXattrs = headerXattrs(res.Header)
+			}
+			return f, nil
+		}
+		if !keyMissing(err) {
+			return filesystem.File{}, err
+		}
+	}
+
+	res, err := fs.bucket.List(dirPrefix(key), "/", "", 1)
+	if err != nil {
+		return filesystem.File{}, err
+	}
+	if len(res.Contents) == 0 && len(res.CommonPrefixes) == 0 {
+		return filesystem.File{}, &os.PathError{Op: "stat", Path: file, Err: os.ErrNotExist}
+	}
+	return fs.keyFile(dirPrefix(key), 0, time.Time{}), nil
 }
 
+// MkDir creates an empty marker object, so that the directory
+// exists even when it has no contents
 func (fs S3FileSystem) MkDir(file filesystem.File) error {
-	return errors.New("Function not yet implemented")
+	key := fs.key(file)
+	if key == "" {
+		return nil
+	}
+	return fs.bucket.Put(dirPrefix(key), []byte{}, "application/x-directory", s3.BucketOwnerFull, xattrsOptions(file))
 }
 
-func (fs S3FileSystem) Delete(file string) error {
-	return fs.Delete(file)
+// Whether err is S3 reporting that a key does not exist
+func keyMissing(err error) bool {
+	e, ok := err.(*s3.Error)
+	return ok && (e.Code == "NoSuchKey" || e.StatusCode == http.StatusNotFound)
 }
 
-func (fs S3FileSystem) FileMap(root filesystem.File) filesystem.FileMap {
+// Delete removes an object, or a directory prefix and everything below it.
+// As with os.RemoveAll, a file that does not exist is not an error
+func (fs S3FileSystem) Delete(file string) error {
+	key := fs.pathKey(file)
+	f, err := fs.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !f.IsDir() {
+		if err = fs.bucket.Del(key); keyMissing(err) {
+			return nil
+		}
+		return err
+	}
+
+	keys := make([]string, 0)
+	err = fs.list(dirPrefix(key), "", func(res *s3.ListResp) {
+		for _, obj := range res.Contents {
+			keys = append(keys, obj.Key)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// At most 1000 keys can be removed in a single request
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > 1000 {
+			n = 1000
+		}
+		objects := make([]s3.Object, n)
+		for i, k := range keys[:n] {
+			objects[i] = s3.Object{Key: k}
+		}
+		if err = fs.bucket.DelMulti(s3.Delete{Quiet: true, Objects: objects}); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
 	return nil
 }
 
+// FileMap lists every key below the root in a single, flat listing.
+// Directories are inferred from the key prefixes, as well as any markers.
+func (fs S3FileSystem) FileMap(root filesystem.File) (filesystem.FileMap, error) {
+	if !root.IsDir() {
+		return nil, nil
+	}
+	base := strings.TrimSuffix(root.Path(), "/")
+	prefix := dirPrefix(fs.key(root))
+
+	fileMap := filesystem.FileMap{"": root}
+	add := func(file filesystem.File) {
+		path := strings.TrimPrefix(file.Path(), base)
+		if _, present := fileMap[path]; !present {
+			fileMap[path] = file
+		}
+	}
+	err := fs.list(prefix, "", func(res *s3.ListResp) {
+		for _, obj := range res.Contents {
+			if obj.Key == prefix {
+				continue
+			}
+			file := fs.objectFile(obj)
+			if Xattrs {
+				file.FileXattrs = fs.headXattrs(obj.Key)
+			}
+			add(file)
+
+			// Every prefix between the root and the object is a directory
+			parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(obj.Key, prefix), "/"), "/")
+			for i := 1; i < len(parts); i++ {
+				add(fs.keyFile(prefix+strings.Join(parts[:i], "/")+"/", 0, time.Time{}))
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fileMap, nil
+}
+
+// FileTree is built from the FileMap, as listing a prefix at a time would
+// take a request per directory
 func (fs S3FileSystem) FileTree(root filesystem.File) *filesystem.FileTree {
-	return nil
+	fileMap, err := fs.FileMap(root)
+	if fileMap == nil || err != nil {
+		return nil
+	}
+	paths := make([]string, 0, len(fileMap))
+	for path := range fileMap {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	nodes := make(map[string]*filesystem.FileTree, len(paths))
+	for _, path := range paths {
+		node := &filesystem.FileTree{StdFile: fileMap[path]}
+		if fileMap[path].IsDir() {
+			node.StdChildNodes = make([]*filesystem.FileTree, 0)
+		}
+		nodes[path] = node
+		if path == "" {
+			continue
+		}
+		parent := nodes[filepath.Dir(path)]
+		if filepath.Dir(path) == "/" {
+			parent = nodes[""]
+		}
+		if parent != nil {
+			node.StdParentNode = parent
+			parent.StdChildNodes = append(parent.StdChildNodes, node)
+		}
+	}
+	return nodes[""]
 }
 
 type S3File struct {
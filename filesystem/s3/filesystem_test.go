@@ -1,11 +1,17 @@
 package s3
 
 import (
+	"bytes"
 	"github.com/goamz/goamz/aws"
-	//"github.com/goamz/goamz/s3"
+	"github.com/goamz/goamz/s3"
+	"github.com/goamz/goamz/s3/s3test"
 	"github.com/mefellows/mirror/filesystem"
+	"io/ioutil"
+	"math/rand"
 	"os"
+	"sort"
 	"testing"
+	"time"
 )
 
 var oldAuthFunc = auth
@@ -133,6 +139,45 @@ func TestConfig_InvalidURL(t *testing.T) {
 	}
 }
 
+func TestConfig_CustomEndpoint(t *testing.T) {
+	conf, err := config("s3://minio.local:9000/mybucket/foo/bar.txt")
+	if err != nil {
+		t.Fatalf("Got unexpected error %s", err.Error())
+	}
+	if conf.bucket != "mybucket" || conf.root != "/mybucket" {
+		t.Fatalf("Bucket name should be 'mybucket' but was %s", conf.bucket)
+	}
+	if conf.endpoint != "https://minio.local:9000" || !conf.pathStyle {
+		t.Fatalf("Expected a path-style endpoint of 'https://minio.local:9000', got %s", conf.endpoint)
+	}
+
+	region := conf.awsRegion()
+	if region.S3Endpoint != "https://minio.local:9000" || region.S3BucketEndpoint != "" {
+		t.Fatalf("Unexpected path-style region: %v", region)
+	}
+	conf.pathStyle = false
+	if region = conf.awsRegion(); region.S3BucketEndpoint != "https://${bucket}.minio.local:9000" {
+		t.Fatalf("Unexpected virtual host region: %v", region.S3BucketEndpoint)
+	}
+
+	if _, err = config("s3://minio.local:9000/mybucket"); err == nil {
+		t.Fatalf("Expected error")
+	}
+}
+
+func TestEndpointConfig_Validate(t *testing.T) {
+	for _, endpoint := range []string{"", "http://localhost:9000", "https://minio.local"} {
+		if err := (EndpointConfig{URL: endpoint}).Validate(); err != nil {
+			t.Fatalf("Expected %s to be valid: %v", endpoint, err)
+		}
+	}
+	for _, endpoint := range []string{"localhost:9000", "ftp://minio.local", "http://"} {
+		if err := (EndpointConfig{URL: endpoint}).Validate(); err == nil {
+			t.Fatalf("Expected %s to be invalid", endpoint)
+		}
+	}
+}
+
 func TestExt(t *testing.T) {
 	file := filesystem.File{FileName: "/foo/bar/baz.txt"}
 	if ext(file) != ".txt" {
@@ -151,3 +196,366 @@ func TestMime(t *testing.T) {
 		t.Fatalf("Expected application/json mime, got %s", mimeType(file))
 	}
 }
+
+// An S3FileSystem backed by a local S3 stand-in, with an empty bucket
+func testS3FileSystem(t *testing.T, url string) (*S3FileSystem, func()) {
+	srv, err := s3test.NewServer(&s3test.Config{})
+	if err != nil {
+		t.Fatalf("Unable to start S3 test server: %v", err)
+	}
+	oldEndpoint := Endpoint
+	Endpoint = EndpointConfig{URL: srv.URL(), PathStyle: true, NoCredentials: true}
+	fs, err := New(url)
+	if err != nil {
+		t.Fatalf("Got unexpected error %s", err.Error())
+	}
+	if err = fs.bucket.PutBucket(s3.Private); err != nil {
+		t.Fatalf("Unable to create test bucket: %v", err)
+	}
+	return fs, func() {
+		Endpoint = oldEndpoint
+		srv.Quit()
+	}
+}
+
+func putTestObjects(t *testing.T, fs *S3FileSystem, keys ...string) {
+	for _, key := range keys {
+		if err := fs.bucket.Put(key, []byte(key), "text/plain", s3.Private, s3.Options{}); err != nil {
+			t.Fatalf("Unable to put %s: %v", key, err)
+		}
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	fs, quit := testS3FileSystem(t, "s3://s3.amazonaws.com/mybucket/")
+	defer quit()
+	putTestObjects(t, fs, "foo/bar.txt")
+
+	file, err := fs.ReadFile("/mybucket/foo/bar.txt")
+	if err != nil {
+		t.Fatalf("Got unexpected error %s", err.Error())
+	}
+	if file.IsDir() || file.Name() != "bar.txt" || file.Path() != "/mybucket/foo/bar.txt" || file.Size() != 11 {
+		t.Fatalf("Unexpected file: %v", file)
+	}
+	if file.ModTime().IsZero() {
+		t.Fatalf("Expected the modification time to be set")
+	}
+
+	dir, err := fs.ReadFile("/mybucket/foo")
+	if err != nil {
+		t.Fatalf("Got unexpected error %s", err.Error())
+	}
+	if !dir.IsDir() || dir.Path() != "/mybucket/foo" {
+		t.Fatalf("Expected a key prefix to be a directory, got %v", dir)
+	}
+
+	_, err = fs.ReadFile("/mybucket/missing")
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected a not exist error, got %v", err)
+	}
+}
+
+func TestReadOpen(t *testing.T) {
+	fs, quit := testS3FileSystem(t, "s3://mybucket.s3.amazonaws.com/")
+	defer quit()
+	putTestObjects(t, fs, "foo/bar.txt")
+
+	file, _ := fs.ReadFile("/foo/bar.txt")
+	data, err := fs.Read(file)
+	if err != nil || string(data) != "foo/bar.txt" {
+		t.Fatalf("Unexpected contents %s, error %v", data, err)
+	}
+	r, err := fs.Open(file)
+	if err != nil {
+		t.Fatalf("Got unexpected error %s", err.Error())
+	}
+	defer r.Close()
+	data, _ = ioutil.ReadAll(r)
+	if string(data) != "foo/bar.txt" {
+		t.Fatalf("Unexpected contents %s", data)
+	}
+}
+
+func TestDir(t *testing.T) {
+	fs, quit := testS3FileSystem(t, "s3://mybucket.s3.amazonaws.com/")
+	defer quit()
+	putTestObjects(t, fs, "a.txt", "b/c.txt", "b/d/e.txt")
+
+	files, err := fs.Dir("/")
+	if err != nil {
+		t.Fatalf("Got unexpected error %s", err.Error())
+	}
+	if len(files) != 2 || files[0].Path() != "/a.txt" || files[1].Path() != "/b" || !files[1].IsDir() {
+		t.Fatalf("Unexpected listing: %v", files)
+	}
+}
+
+func TestFileMap(t *testing.T) {
+	fs, quit := testS3FileSystem(t, "s3://mybucket.s3.amazonaws.com/")
+	defer quit()
+	putTestObjects(t, fs, "root/a.txt", "root/b/c.txt", "root/b/d/e.txt", "root/f/g.txt", "other.txt")
+	fs.MkDir(filesystem.File{FilePath: "/root/empty"})
+
+	// Force the listing to span several pages
+	oldPageSize := listPageSize
+	listPageSize = 2
+	defer func() { listPageSize = oldPageSize }()
+
+	root, _ := fs.ReadFile("/root")
+	fileMap, err := fs.FileMap(root)
+	if err != nil {
+		t.Fatalf("Got unexpected error %s", err.Error())
+	}
+	paths := make([]string, 0)
+	for path := range fileMap {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	expected := []string{"", "/a.txt", "/b", "/b/c.txt", "/b/d", "/b/d/e.txt", "/empty", "/f", "/f/g.txt"}
+	if len(paths) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, paths)
+	}
+	for i := range expected {
+		if paths[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, paths)
+		}
+	}
+	if !fileMap["/b/d"].IsDir() || fileMap["/b/d/e.txt"].IsDir() || !fileMap["/empty"].IsDir() {
+		t.Fatalf("Unexpected file types: %v", fileMap)
+	}
+
+	tree := fs.FileTree(root)
+	if tree == nil || len(tree.ChildNodes()) != 4 {
+		t.Fatalf("Expected 4 children at the root of the tree, got %v", tree)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	fs, quit := testS3FileSystem(t, "s3://mybucket.s3.amazonaws.com/")
+	defer quit()
+	putTestObjects(t, fs, "a.txt", "b/c.txt", "b/d/e.txt", "bb.txt")
+
+	if err := fs.Delete("/a.txt"); err != nil {
+		t.Fatalf("Got unexpected error %s", err.Error())
+	}
+	if err := fs.Delete("/b"); err != nil {
+		t.Fatalf("Got unexpected error %s", err.Error())
+	}
+
+	files, _ := fs.Dir("/")
+	if len(files) != 1 || files[0].Path() != "/bb.txt" {
+		t.Fatalf("Expected only bb.txt to remain, got %v", files)
+	}
+	if err := fs.Delete("/missing"); err != nil {
+		t.Fatalf("Expected deleting a missing file to succeed, got %v", err)
+	}
+}
+
+// Use small parts, and keep upload state in a temporary directory
+func smallParts(t *testing.T) func() {
+	home, err := ioutil.TempDir("", "mirror-s3-home")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	os.Setenv("MIRROR_HOME", home)
+	oldTransfer := Transfer
+	Transfer = TransferConfig{PartSize: 1024, Concurrency: 3, Attempts: 3}
+	return func() {
+		Transfer = oldTransfer
+		os.Setenv("MIRROR_HOME", "")
+		os.RemoveAll(home)
+	}
+}
+
+func TestMultipart(t *testing.T) {
+	defer smallParts(t)()
+	fs, quit := testS3FileSystem(t, "s3://mybucket.s3.amazonaws.com/")
+	defer quit()
+
+	data := make([]byte, 10*1024+100)
+	rand.Read(data)
+	file := filesystem.File{FileName: "big.bin", FilePath: "/big.bin", FileSize: int64(len(data)), FileModTime: time.Now()}
+
+	w, err := fs.Create(file, 0644)
+	if err != nil {
+		t.Fatalf("Got unexpected error %s", err.Error())
+	}
+	if _, ok := w.(*multipartWriter); !ok {
+		t.Fatalf("Expected a multipart upload, got %T", w)
+	}
+	if _, err = w.Write(data); err != nil {
+		t.Fatalf("Got unexpected error %s", err.Error())
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("Got unexpected error %s", err.Error())
+	}
+	if _, err := os.Stat(uploadStateFile("mybucket", "big.bin")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the upload state to be removed once complete")
+	}
+
+	r, err := fs.Open(file)
+	if err != nil {
+		t.Fatalf("Got unexpected error %s", err.Error())
+	}
+	if _, ok := r.(*rangeReader); !ok {
+		t.Fatalf("Expected a ranged download, got %T", r)
+	}
+	read, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatalf("Got unexpected error %s", err.Error())
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatalf("Expected the downloaded object to match the upload")
+	}
+}
+
+func TestMultipart_Resume(t *testing.T) {
+	defer smallParts(t)()
+	fs, quit := testS3FileSystem(t, "s3://mybucket.s3.amazonaws.com/")
+	defer quit()
+
+	data := make([]byte, 5*1024)
+	rand.Read(data)
+	file := filesystem.File{FileName: "big.bin", FilePath: "/big.bin", FileSize: int64(len(data)), FileModTime: time.Now()}
+
+	// An upload interrupted after the first three parts
+	w, _ := fs.Create(file, 0644)
+	first := w.(*multipartWriter)
+	first.Write(data[:3*1024])
+	first.done.Wait()
+
+	state := loadUploadState("mybucket", "big.bin")
+	if state == nil || !state.matches(file) || len(state.Parts) != 3 {
+		t.Fatalf("Expected 3 parts to be recorded, got %v", state)
+	}
+
+	w, _ = fs.Create(file, 0644)
+	second := w.(*multipartWriter)
+	if second.multi.UploadId != first.multi.UploadId {
+		t.Fatalf("Expected the upload to be resumed")
+	}
+	if _, ok := second.state.uploaded(1, data[:1024]); !ok {
+		t.Fatalf("Expected part 1 to be reused")
+	}
+	second.Write(data)
+	if err := second.Close(); err != nil {
+		t.Fatalf("Got unexpected error %s", err.Error())
+	}
+	read, _ := fs.bucket.Get("big.bin")
+	if !bytes.Equal(read, data) {
+		t.Fatalf("Expected the resumed upload to match the File")
+	}
+
+	// A different version of the File starts a new upload
+	file.FileModTime = file.FileModTime.Add(time.Second)
+	w, _ = fs.Create(file, 0644)
+	if w.(*multipartWriter).multi.UploadId == first.multi.UploadId {
+		t.Fatalf("Expected a new upload for a modified File")
+	}
+}
+
+func TestMultipart_CompleteFails(t *testing.T) {
+	defer smallParts(t)()
+	fs, quit := testS3FileSystem(t, "s3://mybucket.s3.amazonaws.com/")
+	defer quit()
+	defer func(complete func(*s3.Multi, []s3.Part) error) { completeMulti = complete }(completeMulti)
+
+	data := make([]byte, 3*1024)
+	rand.Read(data)
+	file := filesystem.File{FileName: "big.bin", FilePath: "/big.bin", FileSize: int64(len(data)), FileModTime: time.Now()}
+
+	// A temporary failure keeps the upload, to be completed next time
+	completeMulti = func(*s3.Multi, []s3.Part) error {
+		return &s3.Error{StatusCode: 503, Code: "ServiceUnavailable"}
+	}
+	w, _ := fs.Create(file, 0644)
+	first := w.(*multipartWriter)
+	first.Write(data)
+	if err := first.Close(); err == nil {
+		t.Fatalf("Expected the upload to fail")
+	}
+	if state := loadUploadState("mybucket", "big.bin"); state == nil || len(state.Parts) != 3 {
+		t.Fatalf("Expected the upload to be kept, got %v", state)
+	}
+
+	completeMulti = func(multi *s3.Multi, parts []s3.Part) error { return multi.Complete(parts) }
+	w, _ = fs.Create(file, 0644)
+	if w.(*multipartWriter).multi.UploadId != first.multi.UploadId {
+		t.Fatalf("Expected the upload to be resumed")
+	}
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Got unexpected error %s", err.Error())
+	}
+	if read, _ := fs.bucket.Get("big.bin"); !bytes.Equal(read, data) {
+		t.Fatalf("Expected the completed upload to match the File")
+	}
+}
+
+func TestMultipart_Stale(t *testing.T) {
+	defer smallParts(t)()
+	fs, quit := testS3FileSystem(t, "s3://mybucket.s3.amazonaws.com/")
+	defer quit()
+
+	data := make([]byte, 5*1024)
+	rand.Read(data)
+	file := filesystem.File{FileName: "big.bin", FilePath: "/big.bin", FileSize: int64(len(data)), FileModTime: time.Now()}
+
+	w, _ := fs.Create(file, 0644)
+	first := w.(*multipartWriter)
+	first.Write(data[:3*1024])
+	first.Abort()
+
+	// The upload of an earlier version of the File is aborted
+	file.FileModTime = file.FileModTime.Add(time.Second)
+	w, _ = fs.Create(file, 0644)
+	if err := first.multi.Abort(); err == nil {
+		t.Fatalf("Expected the stale upload to have been aborted")
+	}
+	w.(*multipartWriter).Abort()
+}
+
+func TestMultipart_Expired(t *testing.T) {
+	defer smallParts(t)()
+	fs, quit := testS3FileSystem(t, "s3://mybucket.s3.amazonaws.com/")
+	defer quit()
+
+	data := make([]byte, 5*1024)
+	rand.Read(data)
+	file := filesystem.File{FileName: "big.bin", FilePath: "/big.bin", FileSize: int64(len(data)), FileModTime: time.Now()}
+
+	// An interrupted upload, which then expires on S3
+	w, _ := fs.Create(file, 0644)
+	first := w.(*multipartWriter)
+	first.Write(data[:3*1024])
+	first.Abort()
+	if err := first.multi.Abort(); err != nil {
+		t.Fatalf("Got unexpected error %s", err.Error())
+	}
+
+	w, _ = fs.Create(file, 0644)
+	w.Write(data)
+	if err := w.Close(); err == nil {
+		t.Fatalf("Expected an error resuming an upload that no longer exists")
+	}
+	if _, err := os.Stat(uploadStateFile("mybucket", "big.bin")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the state of the expired upload to be removed")
+	}
+
+	// The next attempt starts a new upload
+	w, _ = fs.Create(file, 0644)
+	if w.(*multipartWriter).multi.UploadId == first.multi.UploadId {
+		t.Fatalf("Expected a new upload once the old one expired")
+	}
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Got unexpected error %s", err.Error())
+	}
+	read, _ := fs.bucket.Get("big.bin")
+	if !bytes.Equal(read, data) {
+		t.Fatalf("Expected the new upload to match the File")
+	}
+}
@@ -0,0 +1,403 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/goamz/goamz/s3"
+	"github.com/mefellows/mirror/filesystem"
+	"github.com/mefellows/mirror/mirror"
+)
+
+// The smallest part S3 accepts in a multipart upload, other than the last
+const MinPartSize = 5 * 1024 * 1024
+
+// Settings for transferring large objects
+type TransferConfig struct {
+	PartSize    int64 // Size of each part of an upload, and each range of a download
+	Concurrency int   // Number of parts uploaded at once
+	Attempts    int   // Number of times a range is requested before a download fails
+}
+
+// Objects larger than a single part are uploaded in parts, and downloaded in ranges
+var Transfer = TransferConfig{
+	PartSize:    16 * 1024 * 1024,
+	Concurrency: 4,
+	Attempts:    3,
+}
+
+// A multipart upload in progress, recorded so that an interrupted upload
+// can carry on from the last part that completed
+type uploadState struct {
+	Bucket   string
+	Key      string
+	UploadId string
+	Size     int64     // Size of the File being uploaded
+	ModTime  time.Time // Modification time of the File being uploaded
+	PartSize int64
+	Parts    map[int]s3.Part
+	lock     sync.Mutex
+}
+
+func uploadStateFile(bucket string, key string) string {
+	h := sha1.Sum([]byte(bucket + "\x00" + key))
+	return filepath.Join(mirror.GetMirrorDir(), "uploads", hex.EncodeToString(h[:])+".json")
+}
+
+// Load the state of an earlier upload of key, or nil if there is none
+func loadUploadState(bucket string, key string) *uploadState {
+	data, err := ioutil.ReadFile(uploadStateFile(bucket, key))
+	if err != nil {
+		return nil
+	}
+	state := &uploadState{}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil
+	}
+	if state.Parts == nil {
+		state.Parts = make(map[int]s3.Part)
+	}
+	return state
+}
+
+// Whether the upload was of this version of the File, in parts of the
+// current size
+func (s *uploadState) matches(file filesystem.File) bool {
+	return s.Size == file.Size() && s.ModTime.Equal(file.ModTime()) && s.PartSize == Transfer.PartSize
+}
+
+func (s *uploadState) save() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	path := uploadStateFile(s.Bucket, s.Key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *uploadState) remove() {
+	os.Remove(uploadStateFile(s.Bucket, s.Key))
+}
+
+// Whether err means the upload no longer exists, because it expired,
+// was aborted or was completed
+func uploadGone(err error) bool {
+	e, ok := err.(*s3.Error)
+	return ok && (e.Code == "NoSuchUpload" || e.StatusCode == http.StatusNotFound)
+}
+
+// The part previously uploaded with this number and contents, if any
+func (s *uploadState) uploaded(n int, data []byte) (s3.Part, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	part, ok := s.Parts[n]
+	sum := md5.Sum(data)
+	if !ok || part.Size != int64(len(data)) || part.ETag != `"`+hex.EncodeToString(sum[:])+`"` {
+		return s3.Part{}, false
+	}
+	return part, true
+}
+
+func (s *uploadState) add(part s3.Part) {
+	s.lock.Lock()
+	s.Parts[part.N] = part
+	s.lock.Unlock()
+}
+
+// Start, or resume, a multipart upload of a File
+func (fs S3FileSystem) createMultipart(file filesystem.File) (io.WriteCloser, error) {
+	key := fs.key(file)
+	state := loadUploadState(fs.config.bucket, key)
+	if state != nil && !state.matches(file) {
+		// The parts of an upload are billed until it is completed or
+		// aborted, and this one never will be
+		multi := &s3.Multi{Bucket: fs.bucket, Key: key, UploadId: state.UploadId}
+		if err := multi.Abort(); err != nil && !uploadGone(err) {
+			log.Printf("Unable to abort the earlier upload of %s: %v\n", key, err)
+		}
+		state.remove()
+		state = nil
+	}
+	if state == nil {
+		multi, err := fs.bucket.InitMulti(key, mimeType(file), s3.BucketOwnerFull, xattrsOptions(file))
+		if err != nil {
+			return nil, err
+		}
+		state = &uploadState{
+			Bucket:   fs.config.bucket,
+			Key:      key,
+			UploadId: multi.UploadId,
+			Size:     file.Size(),
+			ModTime:  file.ModTime(),
+			PartSize: Transfer.PartSize,
+			Parts:    make(map[int]s3.Part),
+		}
+		if err = state.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	concurrency := Transfer.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &multipartWriter{
+		multi: &s3.Multi{Bucket: fs.bucket, Key: key, UploadId: state.UploadId},
+		state: state,
+		buf:   make([]byte, 0, Transfer.PartSize),
+		slots: make(chan bool, concurrency),
+	}, nil
+}
+
+// Writer for a multipart upload. Each part is buffered in memory, and
+// up to Transfer.Concurrency parts are uploaded at once.
+//
+// If the upload fails, it is left in place to be resumed by the next
+// attempt; parts that were already uploaded are not sent again. An upload
+// that no longer exists on S3 is forgotten instead, so that the next
+// attempt starts a new one.
+type multipartWriter struct {
+	multi *s3.Multi
+	state *uploadState
+	buf   []byte
+	next  int
+	slots chan bool
+	done  sync.WaitGroup
+	lock  sync.Mutex
+	err   error
+	gone  bool // Whether S3 reported that the upload no longer exists
+}
+
+func (w *multipartWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if err := w.failed(); err != nil {
+			return written, err
+		}
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		if len(w.buf) == cap(w.buf) {
+			w.sendPart()
+		}
+	}
+	return written, nil
+}
+
+func (w *multipartWriter) failed() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.err
+}
+
+func (w *multipartWriter) sendPart() {
+	w.next++
+	n, data := w.next, w.buf
+	w.buf = make([]byte, 0, cap(w.buf))
+
+	w.slots <- true
+	w.done.Add(1)
+	go func() {
+		defer func() {
+			<-w.slots
+			w.done.Done()
+		}()
+		if _, ok := w.state.uploaded(n, data); ok {
+			return
+		}
+		part, err := w.multi.PutPart(n, bytes.NewReader(data))
+		if err == nil {
+			w.state.add(part)
+			err = w.state.save()
+		}
+		if err != nil {
+			w.lock.Lock()
+			if w.err == nil {
+				w.err = fmt.Errorf("Error uploading part %d of %s: %v", n, w.multi.Key, err)
+			}
+			if uploadGone(err) {
+				w.gone = true
+			}
+			w.lock.Unlock()
+		}
+	}()
+}
+
+// Close uploads the final part, and completes the upload once every
+// part has been sent
+func (w *multipartWriter) Close() error {
+	if len(w.buf) > 0 || w.next == 0 {
+		w.sendPart()
+	}
+	w.done.Wait()
+	if err := w.failed(); err != nil {
+		w.forgetIfGone()
+		return err
+	}
+
+	parts := make(partsByNumber, 0, w.next)
+	for n := 1; n <= w.next; n++ {
+		parts = append(parts, w.state.Parts[n])
+	}
+	sort.Sort(parts)
+	if err := completeMulti(w.multi, parts); err != nil {
+		// An upload that expired, or was aborted, is started afresh next
+		// time. Otherwise it is kept, and the next attempt completes it.
+		if uploadGone(err) {
+			w.state.remove()
+		}
+		return err
+	}
+	w.state.remove()
+	return nil
+}
+
+// Completes a multipart upload from its parts
+var completeMulti = func(multi *s3.Multi, parts []s3.Part) error {
+	return multi.Complete(parts)
+}
+
+// Abort stops the upload without completing it. The parts already sent are
+// kept, so the next attempt can resume from them; S3 bills for them until
+// the upload is completed, or aborted by a bucket lifecycle rule.
+func (w *multipartWriter) Abort() error {
+	w.done.Wait()
+	w.forgetIfGone()
+	return nil
+}
+
+func (w *multipartWriter) forgetIfGone() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.gone {
+		w.state.remove()
+	}
+}
+
+type partsByNumber []s3.Part
+
+func (p partsByNumber) Len() int           { return len(p) }
+func (p partsByNumber) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p partsByNumber) Less(i, j int) bool { return p[i].N < p[j].N }
+
+// Reads an object a range at a time. A range that fails part-way through
+// is requested again from the last byte received, rather than starting
+// the whole object again.
+type rangeReader struct {
+	bucket   *s3.Bucket
+	key      string
+	size     int64
+	offset   int64
+	end      int64 // End of the current range, exclusive
+	body     io.ReadCloser
+	etag     string
+	attempts int
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	for r.offset < r.size {
+		if r.body == nil {
+			if err := r.fetch(); err != nil {
+				if r.retry() {
+					continue
+				}
+				return 0, err
+			}
+		}
+
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if err == io.EOF && r.offset >= r.end {
+			r.close()
+			err = nil
+		} else if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			r.close()
+			if n > 0 {
+				return n, nil
+			}
+			if r.retry() {
+				continue
+			}
+			return 0, err
+		}
+		r.attempts = 0
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return 0, io.EOF
+}
+
+func (r *rangeReader) retry() bool {
+	r.attempts++
+	return r.attempts < Transfer.Attempts
+}
+
+// Request the next range, making sure the object has not changed
+// since the first one was read
+func (r *rangeReader) fetch() error {
+	r.end = r.offset + Transfer.PartSize
+	if r.end > r.size {
+		r.end = r.size
+	}
+	headers := map[string][]string{
+		"Range": {fmt.Sprintf("bytes=%d-%d", r.offset, r.end-1)},
+	}
+	if r.etag != "" {
+		headers["If-Match"] = []string{r.etag}
+	}
+	res, err := r.bucket.GetResponseWithHeaders(r.key, headers)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return fmt.Errorf("Expected a partial response for %s, got %s", r.key, res.Status)
+	}
+	if etag := res.Header.Get("ETag"); r.etag == "" {
+		r.etag = etag
+	} else if etag != "" && etag != r.etag {
+		res.Body.Close()
+		return fmt.Errorf("%s was modified while being read", r.key)
+	}
+	r.body = res.Body
+	return nil
+}
+
+func (r *rangeReader) close() {
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+}
+
+func (r *rangeReader) Close() error {
+	r.close()
+	return nil
+}
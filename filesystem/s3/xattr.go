@@ -0,0 +1,82 @@
+package s3
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/goamz/goamz/s3"
+	"github.com/mefellows/mirror/filesystem"
+)
+
+// Whether the extended attributes stored with each object are read. Listings
+// do not include metadata, so this takes a HEAD request per object.
+var Xattrs = false
+
+// The user metadata holding the extended attributes of an object,
+// as base64 encoded JSON
+const xattrsMeta = "mirror-xattrs"
+
+// S3 limits the user metadata of an object to 2KB
+const maxMetaSize = 2048
+
+// The Options that store the extended attributes of a File with its object.
+// Attributes too large to store are dropped, rather than failing the upload.
+func xattrsOptions(file filesystem.File) s3.Options {
+	if len(file.FileXattrs) == 0 {
+		return s3.Options{}
+	}
+	data, err := json.Marshal(file.FileXattrs)
+	if err != nil {
+		return s3.Options{}
+	}
+	value := base64.StdEncoding.EncodeToString(data)
+	if len(xattrsMeta)+len(value) > maxMetaSize {
+		log.Printf("Not storing the extended attributes of %s, as they exceed the S3 metadata limit\n", file.Path())
+		return s3.Options{}
+	}
+	return s3.Options{Meta: map[string][]string{xattrsMeta: {value}}}
+}
+
+// The extended attributes stored in the headers of an object, if any
+func headerXattrs(header http.Header) filesystem.Xattrs {
+	attrs := make(filesystem.Xattrs)
+	value := header.Get("X-Amz-Meta-" + xattrsMeta)
+	if value == "" {
+		return attrs
+	}
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err == nil {
+		err = json.Unmarshal(data, &attrs)
+	}
+	if err != nil {
+		log.Printf("Ignoring invalid extended attributes: %v\n", err)
+		return make(filesystem.Xattrs)
+	}
+	return attrs
+}
+
+// The extended attributes of an object, which can only be had with a HEAD
+func (fs S3FileSystem) headXattrs(key string) filesystem.Xattrs {
+	res, err := fs.bucket.Head(key, nil)
+	if err != nil {
+		log.Printf("Unable to read extended attributes of %s: %v\n", key, err)
+		return nil
+	}
+	res.Body.Close()
+	return headerXattrs(res.Header)
+}
+
+// SetXattrs replaces the metadata of an object by copying it onto itself.
+// The attributes of a directory are stored with its marker object.
+func (fs S3FileSystem) SetXattrs(file filesystem.File, attrs filesystem.Xattrs) error {
+	file.FileXattrs = attrs
+	if file.IsDir() {
+		return fs.MkDir(file)
+	}
+	key := fs.key(file)
+	options := s3.CopyOptions{Options: xattrsOptions(file), MetadataDirective: "REPLACE", ContentType: mimeType(file)}
+	_, err := fs.bucket.PutCopy(key, s3.BucketOwnerFull, options, fs.config.bucket+"/"+key)
+	return err
+}
@@ -0,0 +1,53 @@
+package s3
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mefellows/mirror/filesystem"
+)
+
+func TestXattrs(t *testing.T) {
+	fs, quit := testS3FileSystem(t, "s3://s3.amazonaws.com/mybucket/")
+	defer quit()
+	Xattrs = true
+	defer func() { Xattrs = false }()
+
+	attrs := filesystem.Xattrs{"user.origin": []byte("build"), "security.capability": {1, 0, 0, 2}}
+	file := filesystem.File{FileName: "bin", FilePath: "/mybucket/dir/bin", FileSize: 4, FileXattrs: attrs}
+	if err := fs.Write(file, []byte("bin!"), 0755); err != nil {
+		t.Fatalf("Got unexpected error %s", err.Error())
+	}
+	read, err := fs.ReadFile(file.Path())
+	if err != nil {
+		t.Fatalf("Got unexpected error %s", err.Error())
+	}
+	if !read.FileXattrs.Equal(attrs) {
+		t.Fatalf("Expected extended attributes %v, got %v", attrs, read.FileXattrs)
+	}
+
+	// Replacing the attributes leaves the contents alone
+	attrs = filesystem.Xattrs{"user.origin": []byte("release")}
+	if err = fs.SetXattrs(file, attrs); err != nil {
+		t.Fatalf("Got unexpected error %s", err.Error())
+	}
+	root, _ := fs.ReadFile("/mybucket")
+	fileMap, err := fs.FileMap(root)
+	if err != nil {
+		t.Fatalf("Got unexpected error %s", err.Error())
+	}
+	read = fileMap["/dir/bin"]
+	if !read.FileXattrs.Equal(attrs) || read.Size() != 4 {
+		t.Fatalf("Expected extended attributes %v, got %v", attrs, read)
+	}
+	if data, _ := fs.Read(read); string(data) != "bin!" {
+		t.Fatalf("Expected contents to be kept, got %s", data)
+	}
+}
+
+func TestXattrsOptions_TooLarge(t *testing.T) {
+	file := filesystem.File{FilePath: "/big", FileXattrs: filesystem.Xattrs{"user.big": []byte(strings.Repeat("x", maxMetaSize))}}
+	if options := xattrsOptions(file); len(options.Meta) != 0 {
+		t.Fatalf("Expected attributes over the metadata limit to be dropped")
+	}
+}
@@ -0,0 +1,38 @@
+package filesystem
+
+import "fmt"
+
+// How a FileSystem treats symbolic links when reading a directory
+type SymlinkPolicy int
+
+const (
+	SymlinkPreserve SymlinkPolicy = iota // Report links as links, so they can be recreated as links
+	SymlinkFollow                        // Report the File a link points to, in place of the link
+	SymlinkSkip                          // Leave links out altogether
+)
+
+var symlinkPolicyNames = map[SymlinkPolicy]string{
+	SymlinkPreserve: "preserve",
+	SymlinkFollow:   "follow",
+	SymlinkSkip:     "skip",
+}
+
+func (p SymlinkPolicy) String() string {
+	return symlinkPolicyNames[p]
+}
+
+// Look up a SymlinkPolicy by name: preserve, follow or skip
+func NewSymlinkPolicy(name string) (SymlinkPolicy, error) {
+	for policy, n := range symlinkPolicyNames {
+		if n == name {
+			return policy, nil
+		}
+	}
+	return SymlinkPreserve, fmt.Errorf("Unknown symlink policy '%s'. Available policies: preserve, follow, skip", name)
+}
+
+// A FileSystem that can create symbolic links
+type SymlinkFileSystem interface {
+	FileSystem
+	Symlink(file File, target string) error // Create file as a link to target, replacing any File already there
+}
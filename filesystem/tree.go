@@ -1,6 +1,7 @@
 package filesystem
 
 import (
+	"sort"
 	"strings"
 )
 
@@ -63,7 +64,7 @@ func FileTreeDiff(src FileTree, target FileTree, comparators ...func(left File,
 }
 */
 
-func FileMapDiff(src map[string]File, target map[string]File, comparators ...func(left File, right File) bool) (diff []File, err error) {
+func FileMapDiff(src map[string]File, target map[string]File, comparators ...FileComparator) (diff []File, err error) {
 	// Iterate over the src list, comparing each item to the corresponding
 	// match in the target Map
 	diff = make([]File, 0)
@@ -81,6 +82,26 @@ func FileMapDiff(src map[string]File, target map[string]File, comparators ...fun
 	return diff, nil
 }
 
+// Find the Files that exist in target but have no counterpart in src,
+// i.e. the Files that would need to be removed to make target a mirror of src.
+//
+// Files are ordered by path, so that a directory always precedes its contents.
+func FileMapDeletions(src map[string]File, target map[string]File) []File {
+	paths := make([]string, 0)
+	for filename := range target {
+		if _, present := src[filename]; !present {
+			paths = append(paths, filename)
+		}
+	}
+	sort.Strings(paths)
+
+	deletions := make([]File, len(paths))
+	for i, path := range paths {
+		deletions[i] = target[path]
+	}
+	return deletions
+}
+
 // Recursively walk a FileTree and run a self-type function on each node.
 // Walker function is able to mutate the FileTree.
 //
@@ -3,6 +3,7 @@ package filesystem
 import (
 	"errors"
 	"fmt"
+	"os"
 	"testing"
 )
 
@@ -112,7 +113,7 @@ func TestFileTreeDiff(t *testing.T) {
 		node.StdFile = File{FileName: fmt.Sprintf("%d", i), FilePath: fmt.Sprintf("foo/%d", i)}
 		for j := 0; j < 3; j++ {
 			treeNode := &FileTree{}
-			treeNode.StdFile = File{FileName: fmt.Sprintf("%d", i, j), FilePath: fmt.Sprintf("foo/%d/%d", i, j)}
+			treeNode.StdFile = File{FileName: fmt.Sprintf("%d", j), FilePath: fmt.Sprintf("foo/%d/%d", i, j)}
 			nodes[j] = treeNode
 		}
 		node.StdChildNodes = nodes
@@ -133,9 +134,9 @@ func TestFileTreeDiff(t *testing.T) {
 		for j := 0; j < 3; j++ {
 			tree2Node := &FileTree{}
 			if i == 0 {
-				tree2Node.StdFile = File{FileName: fmt.Sprintf("%d", i, j), FilePath: fmt.Sprintf("foo/%d/me-%d", i, j)}
+				tree2Node.StdFile = File{FileName: fmt.Sprintf("%d", j), FilePath: fmt.Sprintf("foo/%d/me-%d", i, j)}
 			} else {
-				tree2Node.StdFile = File{FileName: fmt.Sprintf("%d", i, j), FilePath: fmt.Sprintf("foo/%d/%d", i, j)}
+				tree2Node.StdFile = File{FileName: fmt.Sprintf("%d", j), FilePath: fmt.Sprintf("foo/%d/%d", i, j)}
 			}
 			nodes[j] = tree2Node
 		}
@@ -159,3 +160,29 @@ func TestFileTreeDiff(t *testing.T) {
 		t.Fatalf("First 3 child nodes should be different (foo/{1..3} vs foo2/{1..3}. Got %d", len(diff))
 	}
 }
+
+func TestFileMapDeletions(t *testing.T) {
+	src := map[string]File{
+		"/foo":     File{FileName: "foo", FilePath: "/src/foo"},
+		"/foo/bar": File{FileName: "bar", FilePath: "/src/foo/bar"},
+	}
+	target := map[string]File{
+		"/foo":         File{FileName: "foo", FilePath: "/dest/foo"},
+		"/foo/bar":     File{FileName: "bar", FilePath: "/dest/foo/bar"},
+		"/foo/baz":     File{FileName: "baz", FilePath: "/dest/foo/baz"},
+		"/old":         File{FileName: "old", FilePath: "/dest/old", FileMode: os.ModeDir},
+		"/old/crab":    File{FileName: "crab", FilePath: "/dest/old/crab"},
+		"/old/crab/ho": File{FileName: "ho", FilePath: "/dest/old/crab/ho"},
+	}
+
+	deletions := FileMapDeletions(src, target)
+	if len(deletions) != 4 {
+		t.Fatalf("Expected 4 files to be deleted, got %d", len(deletions))
+	}
+	expected := []string{"/dest/foo/baz", "/dest/old", "/dest/old/crab", "/dest/old/crab/ho"}
+	for i, path := range expected {
+		if deletions[i].Path() != path {
+			t.Fatalf("Expected deletion %d to be %s, got %s", i, path, deletions[i].Path())
+		}
+	}
+}
@@ -39,6 +39,12 @@ func MkToFile(fromBase string, toBase string, file fs.File) fs.File {
 		FileMode:    file.Mode(),
 		FileSize:    file.Size(),
 		FileModTime: file.ModTime(),
+		FileOwner:   file.Owner(),
+		FileGroup:   file.Group(),
+		HasOwner:    file.HasOwner,
+		FileLink:    file.LinkTarget(),
+		FileRdev:    file.FileRdev,
+		FileXattrs:  file.FileXattrs,
 	}
 	return toFile
 }
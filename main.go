@@ -5,6 +5,7 @@ import (
 	"github.com/mefellows/mirror/command"
 	_ "github.com/mefellows/mirror/filesystem/fs"
 	_ "github.com/mefellows/mirror/filesystem/remote"
+	_ "github.com/mefellows/mirror/filesystem/s3"
 	"github.com/mitchellh/cli"
 	"os"
 )
@@ -11,6 +11,23 @@ import (
 // Extension type for adding new FileSystem adapters
 type FileSystemFactory func(protocol string) (filesystem.FileSystem, error)
 
+// Extension type for deciding the outcome of a two-way sync conflict,
+// where path was changed in both src and dest since the last sync.
+//
+// A File that was deleted is given as the zero File. Returning an error
+// aborts the sync.
+type ConflictResolver func(path string, src filesystem.File, dest filesystem.File) (Resolution, error)
+
+// The outcome of a ConflictResolver
+type Resolution int
+
+const (
+	Unresolved Resolution = iota // Leave both sides untouched and report the conflict
+	UseSrc                       // Overwrite dest with src
+	UseDest                      // Overwrite src with dest
+	KeepBoth                     // Keep both versions, renaming the loser
+)
+
 var registry = struct {
 	sync.Mutex
 	extpoints map[string]*plugin
@@ -163,3 +180,45 @@ func (p *fileSystemFactory) Names() []string {
 	}
 	return names
 }
+
+// ConflictResolver
+
+var ConflictResolvers = &conflictResolver{
+	newPlugin(new(ConflictResolver)),
+}
+
+type conflictResolver struct {
+	*plugin
+}
+
+func (p *conflictResolver) Unregister(name string) bool {
+	return p.unregister(name)
+}
+
+func (p *conflictResolver) Register(component ConflictResolver, name string) bool {
+	return p.register(component, name)
+}
+
+func (p *conflictResolver) Lookup(name string) (ConflictResolver, bool) {
+	ext, ok := p.lookup(name)
+	if !ok {
+		return nil, ok
+	}
+	return ext.(ConflictResolver), ok
+}
+
+func (p *conflictResolver) All() map[string]ConflictResolver {
+	all := make(map[string]ConflictResolver)
+	for k, v := range p.all() {
+		all[k] = v.(ConflictResolver)
+	}
+	return all
+}
+
+func (p *conflictResolver) Names() []string {
+	var names []string
+	for k := range p.all() {
+		names = append(names, k)
+	}
+	return names
+}
@@ -36,3 +36,26 @@ func TestLookupFactory(t *testing.T) {
 	}
 
 }
+
+func TestLookupConflictResolver(t *testing.T) {
+	resolver := func(path string, src filesystem.File, dest filesystem.File) (Resolution, error) {
+		return UseDest, nil
+	}
+	if !ConflictResolvers.Register(resolver, "mockresolver") {
+		t.Fatalf("Expected resolver to be registered")
+	}
+	defer ConflictResolvers.Unregister("mockresolver")
+
+	r, ok := ConflictResolvers.Lookup("mockresolver")
+	if !ok {
+		t.Fatalf("Expected lookup to be OK")
+	}
+	res, err := r("/foo", filesystem.File{}, filesystem.File{})
+	if err != nil || res != UseDest {
+		t.Fatalf("Expected UseDest, got %v (err: %v)", res, err)
+	}
+
+	if _, ok := ConflictResolvers.Lookup("doesnotexist"); ok {
+		t.Fatalf("Expected lookup of unknown resolver to fail")
+	}
+}
@@ -0,0 +1,488 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mefellows/mirror/filesystem"
+	utils "github.com/mefellows/mirror/filesystem/utils"
+)
+
+// The kind of change an Operation makes to the destination
+type OpType int
+
+const (
+	OpMkdir   OpType = iota // Create a directory
+	OpCopy                  // Copy a File that does not yet exist in the destination
+	OpUpdate                // Replace a File that already exists in the destination
+	OpDelete                // Remove a File from the destination
+	OpChmod                 // Change the permissions of a File in the destination
+	OpChown                 // Change the owner and group of a File in the destination
+	OpSymlink               // Create a symbolic link in the destination
+	OpMknod                 // Create a FIFO, socket or device node in the destination
+	OpLink                  // Create a hard link to another File in the destination
+	OpXattr                 // Replace the extended attributes of a File in the destination
+)
+
+var opNames = map[OpType]string{
+	OpMkdir:   "mkdir",
+	OpCopy:    "copy",
+	OpUpdate:  "update",
+	OpDelete:  "delete",
+	OpChmod:   "chmod",
+	OpChown:   "chown",
+	OpSymlink: "symlink",
+	OpMknod:   "mknod",
+	OpLink:    "link",
+	OpXattr:   "xattr",
+}
+
+func (t OpType) String() string {
+	return opNames[t]
+}
+
+// A single change to be made to the destination
+type Operation struct {
+	Type   OpType
+	Src    filesystem.File // The source File. Empty for OpDelete
+	Dest   filesystem.File // The destination File
+	Perm   os.FileMode     // The permissions to apply, for OpChmod
+	Owner  int             // The user to apply, for OpChown
+	Group  int             // The group to apply, for OpChown
+	Target filesystem.File // The destination File to link to, for OpLink
+}
+
+func (o Operation) String() string {
+	switch o.Type {
+	case OpCopy, OpUpdate:
+		return fmt.Sprintf("%-6s %s -> %s", o.Type, o.Src.Path(), o.Dest.Path())
+	case OpChmod:
+		return fmt.Sprintf("%-6s %s %s", o.Type, o.Perm, o.Dest.Path())
+	case OpChown:
+		return fmt.Sprintf("%-6s %d:%d %s", o.Type, o.Owner, o.Group, o.Dest.Path())
+	case OpSymlink:
+		return fmt.Sprintf("%-6s %s -> %s", o.Type, o.Dest.Path(), o.Src.LinkTarget())
+	case OpLink:
+		return fmt.Sprintf("%-6s %s -> %s", o.Type, o.Dest.Path(), o.Target.Path())
+	}
+	return fmt.Sprintf("%-6s %s", o.Type, o.Dest.Path())
+}
+
+// The Operations required to make a destination match its source.
+//
+// Operations are ordered so that a directory is created before its
+// contents, and deletions are made last.
+type Plan struct {
+	Src        string
+	Dest       string
+	Operations []Operation
+	fromFs     filesystem.FileSystem
+	toFs       filesystem.FileSystem
+}
+
+// Work out what needs to change in dest to make it match src,
+// without modifying either of them
+func NewPlan(srcRaw string, destRaw string, opts *Options) (*Plan, error) {
+	options = opts
+
+	// Remove from src/dest strings
+	src := utils.ExtractURL(srcRaw).Path
+	dest := utils.ExtractURL(destRaw).Path
+
+	fromFile, fromFs, err := utils.MakeFile(srcRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fromFile.IsDir() {
+		toFile := utils.MkToFile(src, dest, fromFile)
+		toFs, err := utils.GetFileSystemFromFile(destRaw)
+		if err != nil {
+			logOutput("Error opening dest file: %v", err)
+			return nil, fmt.Errorf("Error opening dest file: %v", err)
+		}
+		plan := &Plan{Src: srcRaw, Dest: destRaw, Operations: make([]Operation, 0), fromFs: fromFs, toFs: toFs}
+		if op, ok := singleOperation(fromFile, toFile, toFs); ok {
+			plan.add(op, fromFile, toFile)
+		}
+		return plan, nil
+	}
+
+	// A dest that does not exist yet is created by the sync
+	toFile, toFs, err := utils.MakeFile(destRaw)
+	if toFs == nil {
+		return nil, err
+	}
+
+	// A listing that failed must not be mistaken for an empty one, or
+	// --delete would remove everything in dest
+	var leftMap, rightMap filesystem.FileMap
+	var leftErr, rightErr error
+	var done sync.WaitGroup
+	done.Add(2)
+	go func() {
+		leftMap, leftErr = fromFs.FileMap(fromFile)
+		done.Done()
+	}()
+	go func() {
+		rightMap, rightErr = toFs.FileMap(toFile)
+		done.Done()
+	}()
+	done.Wait()
+	if leftErr != nil {
+		return nil, fmt.Errorf("Unable to list src %s: %v", srcRaw, leftErr)
+	}
+	if rightErr != nil {
+		return nil, fmt.Errorf("Unable to list dest %s: %v", destRaw, rightErr)
+	}
+
+	comparators, err := comparators(fromFs, toFs)
+	if err != nil {
+		return nil, err
+	}
+	diff, err := filesystem.FileMapDiff(leftMap, rightMap, comparators...)
+	if err != nil {
+		return nil, err
+	}
+	changed := make(map[string]bool, len(diff))
+	for _, file := range diff {
+		changed[file.Path()] = true
+	}
+
+	plan := &Plan{Src: srcRaw, Dest: destRaw, Operations: make([]Operation, 0), fromFs: fromFs, toFs: toFs}
+	_, canChmod := toFs.(filesystem.ChmodFileSystem)
+	_, canChown := toFs.(filesystem.ChownFileSystem)
+	_, canSymlink := toFs.(filesystem.SymlinkFileSystem)
+	_, canMknod := toFs.(filesystem.SpecialFileSystem)
+	_, canLink := toFs.(filesystem.HardLinkFileSystem)
+	_, canXattr := toFs.(filesystem.XattrFileSystem)
+	hardLinks := make(map[string]*hardLink)
+
+	paths := make([]string, 0, len(leftMap))
+	for path := range leftMap {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		file := leftMap[path]
+		if ignoreFile(file.Path(), options.Exclude) {
+			continue
+		}
+		to := utils.MkToFile(src, dest, file)
+		existing, exists := rightMap[path]
+
+		isChanged := changed[file.Path()]
+		// Links are compared by their target, as what they point to may not even exist
+		if file.IsSymlink() || (exists && existing.IsSymlink()) {
+			isChanged = !exists || existing.IsSymlink() != file.IsSymlink() || existing.LinkTarget() != file.LinkTarget()
+		}
+
+		switch {
+		case file.IsSymlink() && !canSymlink:
+			logOutput("Skipping symlink %s, as the destination does not support them\n", file.Path())
+			continue
+		case file.IsSpecial() && !(options.Specials && canMknod):
+			logOutput("Skipping special file %s\n", file.Path())
+			continue
+		case file.IsSpecial():
+			isChanged = !exists || existing.Mode()&os.ModeType != file.Mode()&os.ModeType || existing.FileRdev != file.FileRdev
+		}
+
+		// The first of a group of hard links is copied, and the rest linked to it
+		if options.HardLinks && canLink && file.IsHardLink() {
+			key := fmt.Sprintf("%d:%d", file.FileDev, file.FileInode)
+			if first, ok := hardLinks[key]; ok {
+				if first.copied || !first.linkedFrom(existing, exists) {
+					plan.Operations = append(plan.Operations, Operation{Type: OpLink, Src: file, Dest: to, Target: first.dest})
+				}
+				continue
+			}
+			hardLinks[key] = &hardLink{dest: to, existing: rightMap[path], copied: isChanged}
+		}
+
+		if isChanged {
+			switch {
+			case file.IsSymlink():
+				plan.add(OpSymlink, file, to)
+			case file.IsSpecial():
+				plan.add(OpMknod, file, to)
+			case file.IsDir() && !(exists && existing.IsDir()):
+				plan.add(OpMkdir, file, to)
+			case file.IsDir():
+			case exists:
+				plan.add(OpUpdate, file, to)
+			default:
+				plan.add(OpCopy, file, to)
+			}
+		}
+
+		// The destination root is left with its own permissions, and the
+		// permissions of a link are those of its target
+		if canChmod && exists && path != "" && !file.IsSymlink() && !existing.IsSymlink() && existing.Mode().Perm() != file.Mode().Perm() {
+			plan.Operations = append(plan.Operations, Operation{Type: OpChmod, Src: file, Dest: to, Perm: file.Mode().Perm()})
+		}
+
+		// Copies are owned by whoever runs the sync, so new Files need chowning too,
+		// as do updated ones, which replace the File that was there
+		chown := options.PreserveOwner && canChown && file.HasOwner && path != "" &&
+			(!exists || (isChanged && !file.IsDir()) || !existing.HasOwner || existing.Owner() != file.Owner() || existing.Group() != file.Group())
+		if chown {
+			plan.Operations = append(plan.Operations, Operation{Type: OpChown, Src: file, Dest: to, Owner: file.Owner(), Group: file.Group()})
+		}
+
+		// Copies are written with their extended attributes, but a new directory
+		// is not, and a chown clears some attributes, such as capabilities
+		if canXattr && file.FileXattrs != nil && path != "" && !file.IsSymlink() &&
+			((chown && len(file.FileXattrs) > 0) || ((file.IsDir() || !isChanged) && !file.FileXattrs.Equal(existing.FileXattrs))) {
+			plan.add(OpXattr, file, to)
+		}
+	}
+
+	if options.Delete {
+		plan.addDeletions(leftMap, rightMap, src, dest)
+	}
+	return plan, nil
+}
+
+// The first File of a group of hard links in the source
+type hardLink struct {
+	dest     filesystem.File // Where it is copied to
+	existing filesystem.File // What is already there, if anything
+	copied   bool            // Whether it is to be copied, replacing any existing links to it
+}
+
+// Whether the File already in the destination is a link to the first File
+func (h *hardLink) linkedFrom(file filesystem.File, exists bool) bool {
+	return exists && h.existing.FileNlink > 1 && file.FileDev == h.existing.FileDev && file.FileInode == h.existing.FileInode
+}
+
+// The Operation that syncs a single File, such as one a watch reports, or
+// false if it is skipped. Links are skipped under SymlinkSkip, and by
+// destinations that can not hold them; a followed link is read as the File
+// it points to. Special Files are only recreated with Options.Specials, as
+// reading one could block forever.
+func singleOperation(from filesystem.File, to filesystem.File, toFs filesystem.FileSystem) (OpType, bool) {
+	_, canSymlink := toFs.(filesystem.SymlinkFileSystem)
+	_, canMknod := toFs.(filesystem.SpecialFileSystem)
+	switch {
+	case from.IsSymlink() && options.Symlinks == filesystem.SymlinkSkip:
+		logOutput("Skipping symlink %s\n", from.Path())
+		return 0, false
+	case from.IsSymlink() && !canSymlink:
+		logOutput("Skipping symlink %s, as the destination does not support them\n", from.Path())
+		return 0, false
+	case from.IsSymlink():
+		return OpSymlink, true
+	case from.IsSpecial() && !(options.Specials && canMknod):
+		logOutput("Skipping special file %s\n", from.Path())
+		return 0, false
+	case from.IsSpecial():
+		return OpMknod, true
+	case from.IsDir():
+		return OpMkdir, true
+	}
+	if _, err := toFs.ReadFile(to.Path()); err == nil {
+		return OpUpdate, true
+	}
+	return OpCopy, true
+}
+
+func (p *Plan) add(op OpType, src filesystem.File, dest filesystem.File) {
+	p.Operations = append(p.Operations, Operation{Type: op, Src: src, Dest: dest})
+}
+
+// Remove Files from the destination that no longer exist in the source,
+// leaving any that match an exclusion untouched
+func (p *Plan) addDeletions(leftMap filesystem.FileMap, rightMap filesystem.FileMap, src string, dest string) {
+	// Exclusions are expressed in terms of the source path
+	excluded := func(file filesystem.File) bool {
+		return ignoreFile(utils.RelativeFilePath(dest, src, file.Path()), options.Exclude)
+	}
+	var kept []string
+	for _, file := range rightMap {
+		if excluded(file) {
+			kept = append(kept, file.Path())
+		}
+	}
+
+	var deletedDir string
+	for _, file := range filesystem.FileMapDeletions(leftMap, rightMap) {
+		// Deleting a directory removes its contents too
+		if deletedDir != "" && strings.HasPrefix(file.Path(), deletedDir+"/") {
+			continue
+		}
+		if excluded(file) {
+			continue
+		}
+
+		// A directory holding an excluded File stays, and only the rest of
+		// its contents are deleted
+		if file.IsDir() && hasPathBelow(file.Path(), kept) {
+			continue
+		}
+
+		p.Operations = append(p.Operations, Operation{Type: OpDelete, Dest: file})
+		if file.IsDir() {
+			deletedDir = file.Path()
+		}
+	}
+}
+
+func hasPathBelow(dir string, paths []string) bool {
+	for _, path := range paths {
+		if strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// The order in which Operations are carried out. Directories are created
+// one at a time, in order, so that each exists before its contents; every
+// other phase is spread across Options.Parallel workers.
+var phases = []struct {
+	types    []OpType
+	parallel bool
+}{
+	{[]OpType{OpMkdir}, false},
+	{[]OpType{OpCopy, OpUpdate, OpSymlink, OpMknod}, true},
+	{[]OpType{OpLink}, true},  // After the File being linked to is copied
+	{[]OpType{OpChown}, true}, // After any copy, which may replace the File
+	{[]OpType{OpChmod}, true}, // After any chown, which may clear setuid and setgid bits
+	{[]OpType{OpXattr}, true}, // After any chown, which may clear capabilities
+	{[]OpType{OpDelete}, true},
+}
+
+// Carry out every Operation. A failed Operation is recorded in the Result
+// and the rest are still attempted, except for those inside a directory
+// that could not be created. If anything failed, an *ExecuteError
+// holding every error is returned.
+func (p *Plan) Execute() (*Result, error) {
+	start := time.Now()
+	results := make([]OperationResult, len(p.Operations))
+	errs := &errorCollector{}
+	var failedDirs []string // Only appended to by the sequential mkdir phase
+
+	run := func(i int) {
+		op := p.Operations[i]
+		opStart := time.Now()
+		var n int64
+		var err error
+		if dir := parentIn(op.Dest.Path(), failedDirs); dir != "" {
+			err = fmt.Errorf("Parent directory %s could not be created", dir)
+		} else {
+			n, err = p.apply(op)
+		}
+		verified := err == nil && options.Verify && (op.Type == OpCopy || op.Type == OpUpdate)
+		results[i] = OperationResult{Operation: op, Bytes: n, Duration: time.Since(opStart), Err: err, Verified: verified}
+		if err != nil {
+			logOutput("Error during %s of %s: %v", op.Type, op.Dest.Path(), err)
+			errs.add(op, err)
+			if op.Type == OpMkdir {
+				failedDirs = append(failedDirs, op.Dest.Path())
+			}
+		}
+	}
+
+	for _, phase := range phases {
+		ops := make([]int, 0)
+		for i, op := range p.Operations {
+			for _, t := range phase.types {
+				if op.Type == t {
+					ops = append(ops, i)
+				}
+			}
+		}
+		workers := 1
+		if phase.parallel {
+			workers = options.Parallel
+		}
+		runWorkers(workers, ops, run)
+	}
+
+	result := &Result{Src: p.Src, Dest: p.Dest}
+	for _, r := range results {
+		result.add(r)
+	}
+	result.Duration = time.Since(start)
+	return result, errs.err()
+}
+
+// The directory in dirs that contains path, if any
+func parentIn(path string, dirs []string) string {
+	for _, dir := range dirs {
+		if strings.HasPrefix(path, dir+"/") {
+			return dir
+		}
+	}
+	return ""
+}
+
+// A Result describing the Plan without executing it
+func (p *Plan) WhatIf() *Result {
+	result := &Result{Src: p.Src, Dest: p.Dest, WhatIf: true}
+	for _, op := range p.Operations {
+		result.add(OperationResult{Operation: op})
+	}
+	return result
+}
+
+// Carry out a single Operation, returning the bytes sent
+func (p *Plan) apply(op Operation) (int64, error) {
+	switch op.Type {
+	case OpMkdir:
+		logOutput("Mkdir: %s -> %s\n", op.Src.Path(), op.Dest.Path())
+		return 0, p.toFs.MkDir(op.Dest)
+	case OpCopy, OpUpdate:
+		logOutput("Copying file: %s -> %s\n", op.Src.Path(), op.Dest.Path())
+		if options.Verify {
+			return verifiedCopyFile(p.fromFs, op.Src, p.toFs, op.Dest, op.Src.Mode())
+		}
+		return copyFile(p.fromFs, op.Src, p.toFs, op.Dest, op.Src.Mode(), nil)
+	case OpDelete:
+		logOutput("Deleting: %s\n", op.Dest.Path())
+		return 0, DeleteSingle(p.toFs, op.Dest.Path())
+	case OpChmod:
+		logOutput("Chmod: %s %s\n", op.Perm, op.Dest.Path())
+		if chmodFs, ok := p.toFs.(filesystem.ChmodFileSystem); ok {
+			return 0, chmodFs.Chmod(op.Dest, op.Perm)
+		}
+		return 0, fmt.Errorf("Destination does not support changing permissions")
+	case OpChown:
+		logOutput("Chown: %d:%d %s\n", op.Owner, op.Group, op.Dest.Path())
+		if chownFs, ok := p.toFs.(filesystem.ChownFileSystem); ok {
+			return 0, chownFs.Chown(op.Dest, op.Owner, op.Group)
+		}
+		return 0, fmt.Errorf("Destination does not support changing ownership")
+	case OpSymlink:
+		logOutput("Symlink: %s -> %s\n", op.Dest.Path(), op.Src.LinkTarget())
+		if symlinkFs, ok := p.toFs.(filesystem.SymlinkFileSystem); ok {
+			return 0, symlinkFs.Symlink(op.Dest, op.Src.LinkTarget())
+		}
+		return 0, fmt.Errorf("Destination does not support symlinks")
+	case OpMknod:
+		logOutput("Mknod: %s %s\n", op.Src.Mode(), op.Dest.Path())
+		if specialFs, ok := p.toFs.(filesystem.SpecialFileSystem); ok {
+			return 0, specialFs.Mknod(op.Dest)
+		}
+		return 0, fmt.Errorf("Destination does not support special files")
+	case OpLink:
+		logOutput("Link: %s -> %s\n", op.Dest.Path(), op.Target.Path())
+		if linkFs, ok := p.toFs.(filesystem.HardLinkFileSystem); ok {
+			return 0, linkFs.Link(op.Dest, op.Target)
+		}
+		return 0, fmt.Errorf("Destination does not support hard links")
+	case OpXattr:
+		logOutput("Xattr: %s\n", op.Dest.Path())
+		if xattrFs, ok := p.toFs.(filesystem.XattrFileSystem); ok {
+			return 0, xattrFs.SetXattrs(op.Dest, op.Src.FileXattrs)
+		}
+		return 0, fmt.Errorf("Destination does not support extended attributes")
+	}
+	return 0, fmt.Errorf("Unknown operation: %d", op.Type)
+}
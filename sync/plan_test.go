@@ -0,0 +1,371 @@
+package sync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/mefellows/mirror/filesystem"
+	"github.com/mefellows/mirror/filesystem/fs"
+	utils "github.com/mefellows/mirror/filesystem/utils"
+)
+
+func TestNewPlan(t *testing.T) {
+	src, dest := makeSyncDirs(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+
+	writeTestFile(t, filepath.Join(src, "new.txt"), "new")
+	writeTestFile(t, filepath.Join(src, "dir", "child.txt"), "child")
+	writeTestFile(t, filepath.Join(src, "changed.txt"), "changed")
+	writeTestFile(t, filepath.Join(dest, "changed.txt"), "old")
+	writeTestFile(t, filepath.Join(src, "script.sh"), "script")
+	writeTestFile(t, filepath.Join(dest, "script.sh"), "script")
+	writeTestFile(t, filepath.Join(dest, "stale.txt"), "stale")
+
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dest, "changed.txt"), past, past)
+	os.Chmod(filepath.Join(src, "script.sh"), 0755)
+	os.Chtimes(filepath.Join(src, "script.sh"), past, past)
+
+	plan, err := NewPlan(src, dest, &Options{Delete: true})
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+
+	expected := []struct {
+		op   OpType
+		path string
+	}{
+		{OpUpdate, "changed.txt"},
+		{OpMkdir, "dir"},
+		{OpCopy, "dir/child.txt"},
+		{OpCopy, "new.txt"},
+		{OpChmod, "script.sh"},
+		{OpDelete, "stale.txt"},
+	}
+	if len(plan.Operations) != len(expected) {
+		t.Fatalf("Expected %d operations, got %v", len(expected), plan.Operations)
+	}
+	for i, e := range expected {
+		op := plan.Operations[i]
+		if op.Type != e.op || op.Dest.Path() != filepath.Join(dest, e.path) {
+			t.Fatalf("Expected operation %d to be %s %s, got %s", i, e.op, e.path, op)
+		}
+	}
+
+	// Planning alone must not touch the destination
+	if _, err := os.Stat(filepath.Join(dest, "new.txt")); !os.IsNotExist(err) {
+		t.Fatalf("Expected new.txt not to be copied by a plan")
+	}
+	if _, err := os.Stat(filepath.Join(dest, "stale.txt")); err != nil {
+		t.Fatalf("Expected stale.txt not to be deleted by a plan")
+	}
+
+	result, err := plan.Execute()
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if result.Errors != 0 || len(result.Operations) != len(expected) {
+		t.Fatalf("Expected %d successful operations, got %d with %d errors", len(expected), len(result.Operations), result.Errors)
+	}
+	if result.Bytes != int64(len("changed")+len("child")+len("new")) {
+		t.Fatalf("Unexpected number of bytes transferred: %d", result.Bytes)
+	}
+	info, err := os.Stat(filepath.Join(dest, "script.sh"))
+	if err != nil || info.Mode().Perm() != 0755 {
+		t.Fatalf("Expected script.sh to be made executable, got %v", info.Mode())
+	}
+	if _, err := os.Stat(filepath.Join(dest, "dir", "child.txt")); err != nil {
+		t.Fatalf("Expected dir/child.txt to be copied: %v", err)
+	}
+}
+
+func TestNewPlan_ListingFails(t *testing.T) {
+	src, dest := makeSyncDirs(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	writeTestFile(t, filepath.Join(src, "foo.txt"), "foo")
+	writeTestFile(t, filepath.Join(dest, "bar.txt"), "bar")
+
+	listingFails = true
+	defer func() { listingFails = false }()
+	if _, err := NewPlan("flaky://"+src, dest, &Options{Delete: true}); err == nil {
+		t.Fatalf("Expected a failed src listing to fail the plan")
+	}
+	if _, err := NewPlan(src, "flaky://"+dest, &Options{Delete: true}); err == nil {
+		t.Fatalf("Expected a failed dest listing to fail the plan")
+	}
+	if _, err := os.Stat(filepath.Join(dest, "bar.txt")); err != nil {
+		t.Fatalf("Expected dest to be untouched: %v", err)
+	}
+}
+
+func TestExecute_Parallel(t *testing.T) {
+	src, dest := makeSyncDirs(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+
+	for i := 0; i < 50; i++ {
+		writeTestFile(t, filepath.Join(src, fmt.Sprintf("dir%d", i%5), "sub", fmt.Sprintf("file%d.txt", i)), fmt.Sprintf("%d", i))
+	}
+
+	err := Sync(src, dest, &Options{Parallel: 8})
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		path := filepath.Join(dest, fmt.Sprintf("dir%d", i%5), "sub", fmt.Sprintf("file%d.txt", i))
+		data, err := ioutil.ReadFile(path)
+		if err != nil || string(data) != fmt.Sprintf("%d", i) {
+			t.Fatalf("Expected %s to be synced: %v", path, err)
+		}
+	}
+}
+
+func TestExecute_Errors(t *testing.T) {
+	src, dest := makeSyncDirs(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+
+	writeTestFile(t, filepath.Join(src, "dir", "child.txt"), "child")
+	writeTestFile(t, filepath.Join(src, "ok.txt"), "ok")
+	// A File in the way of a directory
+	writeTestFile(t, filepath.Join(dest, "dir"), "blocker")
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dest, "dir"), past, past)
+
+	plan, err := NewPlan(src, dest, &Options{Parallel: 4})
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	result, err := plan.Execute()
+	executeErr, ok := err.(*ExecuteError)
+	if !ok {
+		t.Fatalf("Expected an ExecuteError, got %v", err)
+	}
+	if len(executeErr.Errors) != 2 || result.Errors != 2 {
+		t.Fatalf("Expected the mkdir and the copy of its child to fail, got %v", executeErr)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "ok.txt")); err != nil {
+		t.Fatalf("Expected ok.txt to be synced despite other failures: %v", err)
+	}
+}
+
+func TestNewPlan_PreserveOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Changing ownership requires root")
+	}
+	src, dest := makeSyncDirs(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+
+	writeTestFile(t, filepath.Join(src, "new.txt"), "new")
+	writeTestFile(t, filepath.Join(src, "same.txt"), "same")
+	writeTestFile(t, filepath.Join(dest, "same.txt"), "same")
+	os.Chown(filepath.Join(src, "new.txt"), 1234, 5678)
+	os.Chown(filepath.Join(src, "same.txt"), 1234, 5678)
+
+	plan, err := NewPlan(src, dest, &Options{PreserveOwner: true})
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	chowns := 0
+	for _, op := range plan.Operations {
+		if op.Type == OpChown {
+			chowns++
+		}
+	}
+	if chowns != 2 {
+		t.Fatalf("Expected both files to be chowned, got %v", plan.Operations)
+	}
+	if _, err = plan.Execute(); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+
+	for _, name := range []string{"new.txt", "same.txt"} {
+		file, _, err := utils.MakeFile(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatalf("Did not expect err: %v", err)
+		}
+		if file.Owner() != 1234 || file.Group() != 5678 {
+			t.Fatalf("Expected %s to be owned by 1234:5678, got %d:%d", name, file.Owner(), file.Group())
+		}
+	}
+
+	// Once in sync, there is nothing left to do
+	plan, _ = NewPlan(src, dest, &Options{PreserveOwner: true})
+	if len(plan.Operations) != 0 {
+		t.Fatalf("Expected no further operations, got %v", plan.Operations)
+	}
+}
+
+func TestNewPlan_Symlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Symlinks require privileges on Windows")
+	}
+	src, dest := makeSyncDirs(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+
+	writeTestFile(t, filepath.Join(src, "file.txt"), "file")
+	os.Symlink("file.txt", filepath.Join(src, "link.txt"))
+	// A stale link in the destination is retargeted
+	os.Symlink("old.txt", filepath.Join(dest, "link.txt"))
+
+	if err := Sync(src, dest, &Options{}); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	target, err := os.Readlink(filepath.Join(dest, "link.txt"))
+	if err != nil || target != "file.txt" {
+		t.Fatalf("Expected link.txt to link to file.txt, got %s: %v", target, err)
+	}
+
+	plan, err := NewPlan(src, dest, &Options{})
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if len(plan.Operations) != 0 {
+		t.Fatalf("Expected no further operations, got %v", plan.Operations)
+	}
+}
+
+func TestCopySingle_Symlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Symlinks require privileges on Windows")
+	}
+	src, dest := makeSyncDirs(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+
+	writeTestFile(t, filepath.Join(src, "file.txt"), "file")
+	link := filepath.Join(src, "link.txt")
+	os.Symlink("file.txt", link)
+
+	options = &Options{Symlinks: filesystem.SymlinkSkip}
+	CopySingle(fs.StdFileSystem{}, link, fs.StdFileSystem{}, filepath.Join(dest, "link.txt"))
+	if _, err := os.Lstat(filepath.Join(dest, "link.txt")); !os.IsNotExist(err) {
+		t.Fatalf("Expected link.txt to be skipped")
+	}
+
+	options = &Options{}
+	CopySingle(fs.StdFileSystem{}, link, fs.StdFileSystem{}, filepath.Join(dest, "link.txt"))
+	if target, err := os.Readlink(filepath.Join(dest, "link.txt")); err != nil || target != "file.txt" {
+		t.Fatalf("Expected link.txt to link to file.txt, got %s: %v", target, err)
+	}
+}
+
+func TestNewPlan_HardLinksAndSpecials(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("No FIFOs on Windows")
+	}
+	src, dest := makeSyncDirs(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+
+	writeTestFile(t, filepath.Join(src, "a.txt"), "shared")
+	os.Link(filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt"))
+	fifo := filesystem.File{FileName: "fifo", FilePath: filepath.Join(src, "fifo"), FileMode: os.ModeNamedPipe | 0644}
+	if err := (fs.StdFileSystem{}).Mknod(fifo); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+
+	// Skipped by default, rather than blocking on a read of the FIFO
+	if err := Sync(src, dest, &Options{HardLinks: true, Compare: []string{"hash"}}); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "fifo")); !os.IsNotExist(err) {
+		t.Fatalf("Expected fifo to be skipped")
+	}
+	a, _ := os.Stat(filepath.Join(dest, "a.txt"))
+	b, _ := os.Stat(filepath.Join(dest, "b.txt"))
+	if !os.SameFile(a, b) {
+		t.Fatalf("Expected a.txt and b.txt to be hard linked")
+	}
+
+	plan, err := NewPlan(src, dest, &Options{HardLinks: true, Specials: true})
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if len(plan.Operations) != 1 || plan.Operations[0].Type != OpMknod {
+		t.Fatalf("Expected only the fifo to be created, got %v", plan.Operations)
+	}
+	if _, err = plan.Execute(); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if info, err := os.Lstat(filepath.Join(dest, "fifo")); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+		t.Fatalf("Expected fifo to be recreated: %v", err)
+	}
+}
+
+func TestCopySingle_Specials(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("No FIFOs on Windows")
+	}
+	src, dest := makeSyncDirs(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+
+	fifo := filesystem.File{FileName: "fifo", FilePath: filepath.Join(src, "fifo"), FileMode: os.ModeNamedPipe | 0644}
+	if err := (fs.StdFileSystem{}).Mknod(fifo); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+
+	// As a watch would, rather than blocking on a read of the FIFO
+	copied := make(chan error)
+	for _, opts := range []*Options{{}, {Specials: true}} {
+		options = opts
+		go func() {
+			copied <- CopySingle(fs.StdFileSystem{}, fifo.Path(), fs.StdFileSystem{}, filepath.Join(dest, "fifo"))
+		}()
+		select {
+		case err := <-copied:
+			if err != nil {
+				t.Fatalf("Did not expect err: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the fifo not to be read")
+		}
+		info, err := os.Lstat(filepath.Join(dest, "fifo"))
+		if !opts.Specials && !os.IsNotExist(err) {
+			t.Fatalf("Expected fifo to be skipped")
+		}
+		if opts.Specials && (err != nil || info.Mode()&os.ModeNamedPipe == 0) {
+			t.Fatalf("Expected fifo to be recreated: %v", err)
+		}
+	}
+}
+
+func TestNewPlan_Xattrs(t *testing.T) {
+	src, dest := makeSyncDirs(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	fs.Xattrs = true
+	defer func() { fs.Xattrs = false }()
+
+	writeTestFile(t, filepath.Join(src, "file.txt"), "file")
+	writeTestFile(t, filepath.Join(dest, "file.txt"), "file")
+	attrs := filesystem.Xattrs{"user.mirror": []byte("test")}
+	if err := (fs.StdFileSystem{}).SetXattrs(filesystem.File{FilePath: filepath.Join(src, "file.txt")}, attrs); err != nil {
+		t.Skipf("Extended attributes are not supported: %v", err)
+	}
+
+	plan, err := NewPlan(src, dest, &Options{})
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if len(plan.Operations) != 1 || plan.Operations[0].Type != OpXattr {
+		t.Fatalf("Expected only the extended attributes to be updated, got %v", plan.Operations)
+	}
+	if _, err = plan.Execute(); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	file, _, _ := utils.MakeFile(filepath.Join(dest, "file.txt"))
+	if !file.FileXattrs.Equal(attrs) {
+		t.Fatalf("Expected %v, got %v", attrs, file.FileXattrs)
+	}
+}
@@ -0,0 +1,44 @@
+package sync
+
+import (
+	"fmt"
+
+	"github.com/mefellows/mirror/filesystem"
+	"github.com/mefellows/mirror/mirror"
+)
+
+func init() {
+	mirror.ConflictResolvers.Register(NewestWins, "newest-wins")
+	mirror.ConflictResolvers.Register(SourceWins, "source-wins")
+	mirror.ConflictResolvers.Register(DestWins, "dest-wins")
+	mirror.ConflictResolvers.Register(KeepBoth, "keep-both")
+	mirror.ConflictResolvers.Register(FailOnConflict, "fail")
+}
+
+// The most recently modified version wins. A deleted File is
+// always older than one that still exists.
+func NewestWins(path string, src filesystem.File, dest filesystem.File) (mirror.Resolution, error) {
+	if dest.ModTime().After(src.ModTime()) {
+		return mirror.UseDest, nil
+	}
+	return mirror.UseSrc, nil
+}
+
+func SourceWins(path string, src filesystem.File, dest filesystem.File) (mirror.Resolution, error) {
+	return mirror.UseSrc, nil
+}
+
+func DestWins(path string, src filesystem.File, dest filesystem.File) (mirror.Resolution, error) {
+	return mirror.UseDest, nil
+}
+
+// Keep both versions: the newest keeps the original name, and the other is
+// renamed to <path>.conflict-<host>-<timestamp> on both sides
+func KeepBoth(path string, src filesystem.File, dest filesystem.File) (mirror.Resolution, error) {
+	return mirror.KeepBoth, nil
+}
+
+// Abort the sync on the first conflict
+func FailOnConflict(path string, src filesystem.File, dest filesystem.File) (mirror.Resolution, error) {
+	return mirror.Unresolved, fmt.Errorf("Conflict: %s was changed on both sides", path)
+}
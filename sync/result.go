@@ -0,0 +1,105 @@
+package sync
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// The outcome of a single Operation
+type OperationResult struct {
+	Operation
+	Bytes    int64         // Bytes of File data sent to the destination
+	Duration time.Duration // Time taken to carry out the Operation
+	Err      error         // Why the Operation failed, if it did
+	Verified bool          // The copy was checked against the source, and matched
+}
+
+// The outcome of executing a Plan, or the Operations it would perform
+// if it is only a dry run
+type Result struct {
+	Src          string
+	Dest         string
+	WhatIf       bool // The Operations were planned, but not executed
+	Operations   []OperationResult
+	Bytes        int64 // Total bytes of File data sent to the destination
+	Errors       int   // Number of failed Operations
+	Verified     int   // Number of copies checked against the source that matched
+	VerifyFailed int   // Number of copies that still did not match the source after being sent again
+	Duration     time.Duration
+}
+
+func (r *Result) add(op OperationResult) {
+	r.Operations = append(r.Operations, op)
+	r.Bytes += op.Bytes
+	if op.Err != nil {
+		r.Errors++
+	}
+	if op.Verified {
+		r.Verified++
+	}
+	if _, ok := op.Err.(*VerifyError); ok {
+		r.VerifyFailed++
+	}
+}
+
+// Durations are reported in milliseconds, and errors as their messages
+func (o OperationResult) MarshalJSON() ([]byte, error) {
+	doc := struct {
+		Op         string  `json:"op"`
+		Src        string  `json:"src,omitempty"`
+		Dest       string  `json:"dest"`
+		Perm       string  `json:"perm,omitempty"`
+		Target     string  `json:"target,omitempty"`
+		Owner      *int    `json:"owner,omitempty"`
+		Group      *int    `json:"group,omitempty"`
+		Bytes      int64   `json:"bytes"`
+		Verified   bool    `json:"verified,omitempty"`
+		DurationMs float64 `json:"duration_ms"`
+		Error      string  `json:"error,omitempty"`
+	}{
+		Op:         o.Type.String(),
+		Src:        o.Src.Path(),
+		Dest:       o.Dest.Path(),
+		Bytes:      o.Bytes,
+		Verified:   o.Verified,
+		DurationMs: milliseconds(o.Duration),
+	}
+	if o.Type == OpChmod {
+		doc.Perm = o.Perm.String()
+	}
+	switch o.Type {
+	case OpSymlink:
+		doc.Target = o.Src.LinkTarget()
+	case OpLink:
+		doc.Target = o.Target.Path()
+	}
+	if o.Type == OpChown {
+		doc.Owner, doc.Group = &o.Owner, &o.Group
+	}
+	if o.Err != nil {
+		doc.Error = o.Err.Error()
+	}
+	return json.Marshal(doc)
+}
+
+func (r *Result) MarshalJSON() ([]byte, error) {
+	operations := r.Operations
+	if operations == nil {
+		operations = []OperationResult{}
+	}
+	return json.Marshal(struct {
+		Src          string            `json:"src"`
+		Dest         string            `json:"dest"`
+		WhatIf       bool              `json:"whatif"`
+		Operations   []OperationResult `json:"operations"`
+		Bytes        int64             `json:"bytes"`
+		Errors       int               `json:"errors"`
+		Verified     int               `json:"verified"`
+		VerifyFailed int               `json:"verify_failed"`
+		DurationMs   float64           `json:"duration_ms"`
+	}{r.Src, r.Dest, r.WhatIf, operations, r.Bytes, r.Errors, r.Verified, r.VerifyFailed, milliseconds(r.Duration)})
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
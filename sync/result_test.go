@@ -0,0 +1,56 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mefellows/mirror/filesystem"
+)
+
+func TestResult_MarshalJSON(t *testing.T) {
+	result := &Result{Src: "/src", Dest: "/dest", Duration: 1500 * time.Microsecond}
+	result.add(OperationResult{
+		Operation: Operation{Type: OpCopy, Src: filesystem.File{FilePath: "/src/foo"}, Dest: filesystem.File{FilePath: "/dest/foo"}},
+		Bytes:     10,
+		Duration:  time.Millisecond,
+	})
+	result.add(OperationResult{
+		Operation: Operation{Type: OpChmod, Dest: filesystem.File{FilePath: "/dest/bar"}, Perm: 0755},
+		Err:       errors.New("permission denied"),
+	})
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+
+	var doc struct {
+		Src        string
+		Bytes      int64
+		Errors     int
+		DurationMs float64 `json:"duration_ms"`
+		Operations []map[string]interface{}
+	}
+	if err = json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if doc.Src != "/src" || doc.Bytes != 10 || doc.Errors != 1 || doc.DurationMs != 1.5 {
+		t.Fatalf("Unexpected result document: %s", data)
+	}
+	if len(doc.Operations) != 2 {
+		t.Fatalf("Expected 2 operations, got %s", data)
+	}
+	if doc.Operations[0]["op"] != "copy" || doc.Operations[0]["src"] != "/src/foo" || doc.Operations[0]["dest"] != "/dest/foo" {
+		t.Fatalf("Unexpected copy operation: %v", doc.Operations[0])
+	}
+	if doc.Operations[1]["perm"] != os.FileMode(0755).String() || doc.Operations[1]["error"] != "permission denied" {
+		t.Fatalf("Unexpected chmod operation: %v", doc.Operations[1])
+	}
+	if strings.Contains(string(data), `"src":""`) {
+		t.Fatalf("Expected an empty src to be omitted: %s", data)
+	}
+}
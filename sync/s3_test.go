@@ -0,0 +1,54 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/goamz/goamz/aws"
+	"github.com/goamz/goamz/s3"
+	"github.com/goamz/goamz/s3/s3test"
+	s3fs "github.com/mefellows/mirror/filesystem/s3"
+)
+
+// Sync a directory to a local S3 stand-in, and back again
+func TestSync_S3(t *testing.T) {
+	srv, err := s3test.NewServer(&s3test.Config{})
+	if err != nil {
+		t.Fatalf("Unable to start S3 test server: %v", err)
+	}
+	defer srv.Quit()
+	s3fs.Endpoint = s3fs.EndpointConfig{URL: srv.URL(), PathStyle: true, NoCredentials: true}
+	defer func() { s3fs.Endpoint = s3fs.EndpointConfig{} }()
+
+	region := aws.Region{Name: "faux-region-1", S3Endpoint: srv.URL(), S3LocationConstraint: true}
+	if err = s3.New(aws.Auth{}, region).Bucket("mybucket").PutBucket(s3.Private); err != nil {
+		t.Fatalf("Unable to create test bucket: %v", err)
+	}
+	bucketURL := "s3://" + strings.TrimPrefix(srv.URL(), "http://") + "/mybucket/"
+
+	src, dest := makeSyncDirs(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	writeTestFile(t, filepath.Join(src, "foo.txt"), "foo")
+	writeTestFile(t, filepath.Join(src, "bar", "baz.txt"), "baz")
+
+	if err = Sync(src, bucketURL+"backup", &Options{}); err != nil {
+		t.Fatalf("Did not expect err syncing to S3: %v", err)
+	}
+	if err = Sync(bucketURL+"backup", dest, &Options{}); err != nil {
+		t.Fatalf("Did not expect err syncing from S3: %v", err)
+	}
+
+	for path, contents := range map[string]string{"foo.txt": "foo", "bar/baz.txt": "baz"} {
+		data, err := ioutil.ReadFile(filepath.Join(dest, path))
+		if err != nil {
+			t.Fatalf("Expected %s to be synced: %v", path, err)
+		}
+		if string(data) != contents {
+			t.Fatalf("Expected %s to contain '%s', got '%s'", path, contents, data)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package sync
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mefellows/mirror/filesystem"
+	"github.com/mefellows/mirror/mirror"
+)
+
+// The state of a single file, as it was when last synchronised
+type FileState struct {
+	Size    int64
+	ModTime time.Time
+	Hash    string
+	IsDir   bool
+}
+
+// The last synchronised state of a path, on each side of the sync
+type PathState struct {
+	Src  FileState
+	Dest FileState
+}
+
+// A record of the last successful two-way sync between src and dest,
+// used to tell which side a change was made on.
+//
+// Paths are relative to the src and dest roots.
+type State struct {
+	Src   string
+	Dest  string
+	Files map[string]PathState
+}
+
+// Location of the state database for a given src/dest pair
+func StateFile(src string, dest string) string {
+	h := sha1.Sum([]byte(src + "\x00" + dest))
+	return filepath.Join(mirror.GetMirrorDir(), "state", hex.EncodeToString(h[:])+".json")
+}
+
+// Load the state of the last sync between src and dest.
+// An empty State is returned if they have never been synchronised.
+func LoadState(src string, dest string) (*State, error) {
+	state := &State{Src: src, Dest: dest, Files: make(map[string]PathState)}
+	data, err := ioutil.ReadFile(StateFile(src, dest))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]PathState)
+	}
+	return state, nil
+}
+
+// Persist the State, replacing any previous copy
+func (s *State) Save() error {
+	path := StateFile(s.Src, s.Dest)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func newFileState(file filesystem.File, hash string) FileState {
+	return FileState{
+		Size:    file.Size(),
+		ModTime: file.ModTime(),
+		Hash:    hash,
+		IsDir:   file.IsDir(),
+	}
+}
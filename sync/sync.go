@@ -1,21 +1,37 @@
 package sync
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
+	"hash"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
-	"sync"
 
 	"github.com/mefellows/mirror/filesystem"
+	"github.com/mefellows/mirror/filesystem/delta"
 	utils "github.com/mefellows/mirror/filesystem/utils"
+	"github.com/mefellows/mirror/mirror"
 	"gopkg.in/fsnotify.v1"
 )
 
 type Options struct {
-	Exclude []regexp.Regexp
-	Verbose bool
+	Exclude       []regexp.Regexp
+	Verbose       bool
+	Delete        bool                     // Remove files from dest that no longer exist in src
+	Resolver      mirror.ConflictResolver  // Resolves conflicts in a two-way sync. If nil, conflicts are reported
+	Checksum      bool                     // Compare Files by the hash of their contents, rather than modification time
+	Compare       []string                 // Names of the comparators used to detect changed Files. Defaults to mtime
+	Parallel      int                      // Number of Operations carried out at once. Defaults to 1
+	HashAlgorithm string                   // The algorithm used with Checksum. Defaults to SHA-256
+	PreserveOwner bool                     // Give Files in dest the same owner and group as in src
+	HardLinks     bool                     // Recreate groups of hard links in src as hard links in dest, rather than separate copies
+	Specials      bool                     // Recreate FIFOs, sockets and device nodes in dest. By default they are skipped
+	Verify        bool                     // Hash each File in dest once it is copied, and check it against src
+	Symlinks      filesystem.SymlinkPolicy // How links in src are synced. src is listed with this policy by the command, so it is only checked for single Files
 }
 
 var options *Options
@@ -27,111 +43,252 @@ func logOutput(format string, v ...interface{}) {
 
 }
 
+// Make dest match src, by planning the Operations required and then
+// carrying them out
 func Sync(srcRaw string, destRaw string, opts *Options) error {
-	options = opts
+	plan, err := NewPlan(srcRaw, destRaw, opts)
+	if err != nil {
+		return err
+	}
+	_, err = plan.Execute()
+	return err
+}
 
-	// Remove from src/dest strings
-	src := utils.ExtractURL(srcRaw).Path
-	dest := utils.ExtractURL(destRaw).Path
+// The FileComparators used to decide which Files need copying
+func comparators(fromFs filesystem.FileSystem, toFs filesystem.FileSystem) ([]filesystem.FileComparator, error) {
+	names := options.Compare
+	if len(names) > 0 && options.Checksum {
+		return nil, fmt.Errorf("Checksum can not be used with Compare; add hash to Compare instead")
+	}
+	if len(names) == 0 {
+		names = []string{"mtime"}
+		if options.Checksum {
+			names = []string{"hash"}
+		}
+	}
+	return filesystem.NewComparators(names, fromFs, toFs, hashAlgorithm())
+}
 
-	// Get a handle on the to/from Filesystems
-	fromFile, fromFs, err := utils.MakeFile(srcRaw)
+// The algorithm Files are hashed with. Defaults to SHA-256
+func hashAlgorithm() string {
+	if options.HashAlgorithm == "" {
+		return filesystem.SHA256
+	}
+	return options.HashAlgorithm
+}
+
+func DeleteSingle(destFs filesystem.FileSystem, destRaw string) error {
+	return destFs.Delete(destRaw)
+}
+
+func CopySingle(srcFs filesystem.FileSystem, srcRaw string, destFs filesystem.FileSystem, destRaw string) error {
+	fromFile, _, err := utils.MakeFile(srcRaw)
+	toFile := utils.MkToFile(srcRaw, destRaw, fromFile)
 
 	if err != nil {
-		return err
+		logOutput("Error opening dest file: %v", err)
+		return fmt.Errorf("Error opening dest file: %v", err)
 	}
-	if fromFile.IsDir() {
-		toFile, toFs, err := utils.MakeFile(destRaw)
-
-		var leftMap filesystem.FileMap
-		var rightMap filesystem.FileMap
-		var done sync.WaitGroup
-		done.Add(2)
-		go func() {
-			leftMap = fromFs.FileMap(fromFile)
-			done.Done()
-		}()
-		go func() {
-			rightMap = toFs.FileMap(toFile)
-			done.Done()
-		}()
-		done.Wait()
-		diff, err := filesystem.FileMapDiff(
-			leftMap, rightMap, filesystem.ModifiedComparator)
-
-		if err == nil {
-			for _, file := range diff {
 
-				if ignoreFile(file.Path(), options.Exclude) {
-					continue
-				}
-				toFile = utils.MkToFile(src, dest, file)
+	// Carried out as a Plan would, so the same Files are skipped
+	op, ok := singleOperation(fromFile, toFile, destFs)
+	if !ok {
+		return nil
+	}
+	plan := &Plan{fromFs: srcFs, toFs: destFs}
+	if _, err := plan.apply(Operation{Type: op, Src: fromFile, Dest: toFile}); err != nil {
+		logOutput("Error during %s of %s: %v", op, toFile.Path(), err)
+	}
 
-				if err == nil {
-					if file.IsDir() {
-						logOutput("Mkdir: %s -> %s\n", file.Path(), toFile.Path())
-						toFs.MkDir(toFile)
-					} else {
-						logOutput("Copying file: %s -> %s\n", file.Path(), toFile.Path())
-						bytes, err := fromFs.Read(file)
-						err = toFs.Write(toFile, bytes, file.Mode())
-						if err != nil {
-							logOutput("Error copying file %s: %v", file.Path(), err)
-						}
-					}
-				}
+	return nil
+}
+
+// Stream the contents of a File from one FileSystem to another,
+// without holding the whole File in memory.
+//
+// If the destination already has a copy of the File and supports delta
+// transfers, only the changed blocks are sent.
+//
+// Otherwise, large Files are sent so that an interrupted transfer can be
+// resumed by the next one.
+//
+// If h is non-nil, the source contents are also written to it as they are read.
+//
+// Returns the number of bytes of File data sent to the destination.
+func copyFile(fromFs filesystem.FileSystem, from filesystem.File, toFs filesystem.FileSystem, to filesystem.File, perm os.FileMode, h hash.Hash) (int64, error) {
+	if deltaFs, ok := toFs.(filesystem.DeltaFileSystem); ok {
+		if existing, err := toFs.ReadFile(to.Path()); err == nil && !existing.IsDir() && existing.Size() > 0 {
+			// The signature may be refused, e.g. by a write-only export, in
+			// which case the File is sent whole
+			sig, err := deltaFs.Signature(to, delta.BlockSize(existing.Size()))
+			if err == nil {
+				logOutput("Sending delta: %s -> %s\n", from.Path(), to.Path())
+				return deltaCopyFile(fromFs, from, deltaFs, to, sig, perm, h)
 			}
+			logOutput("Unable to send a delta of %s, sending it whole: %v\n", to.Path(), err)
+		}
+	}
+	if resumeFs, ok := toFs.(filesystem.ResumeFileSystem); ok && from.Size() >= resumeSize {
+		return resumeCopyFile(fromFs, from, resumeFs, to, perm, h)
+	}
+
+	r, err := openSource(fromFs, from, h)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	w, err := toFs.Create(to, perm)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		if a, ok := w.(filesystem.AbortWriter); ok {
+			a.Abort()
 		} else {
-			logOutput("Error: %v\n", err)
+			w.Close()
 		}
-	} else {
-		toFile := utils.MkToFile(src, dest, fromFile)
-		toFs, err := utils.GetFileSystemFromFile(destRaw)
+		return n, err
+	}
+	return n, w.Close()
+}
+
+// The number of times a File that fails verification is sent, in all
+const verifyAttempts = 3
+
+// A copy of a File whose hash does not match the source
+type VerifyError struct {
+	File     filesystem.File
+	Expected string
+	Actual   string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("Verification of %s failed: expected hash %s, got %s", e.File.Path(), e.Expected, e.Actual)
+}
+
+// Copy a File as copyFile does, then have the destination hash the copy
+// and check it against the source. The hash is calculated by the remote
+// daemon itself, or taken from the ETag of an S3 object where possible.
+//
+// A copy that does not match is sent again, up to verifyAttempts times in
+// all, before giving up with a *VerifyError.
+func verifiedCopyFile(fromFs filesystem.FileSystem, from filesystem.File, toFs filesystem.FileSystem, to filesystem.File, perm os.FileMode) (int64, error) {
+	algorithm := hashAlgorithm()
+	var sent int64
+	for attempt := 1; ; attempt++ {
+		h, err := filesystem.NewHash(algorithm)
 		if err != nil {
-			logOutput("Error opening dest file: %v", err)
-			return fmt.Errorf("Error opening dest file: %v", err)
+			return sent, err
 		}
-
-		bytes, err := fromFs.Read(fromFile)
+		n, err := copyFile(fromFs, from, toFs, to, perm, h)
+		sent += n
 		if err != nil {
-			logOutput("Error reading from source file: %s", err.Error())
-			return fmt.Errorf("Error reading source file: %v", err)
+			return sent, err
 		}
-		err = toFs.Write(toFile, bytes, toFile.Mode())
+		actual, err := filesystem.FileHash(toFs, to, algorithm)
 		if err != nil {
-			logOutput("Error writing to remote path: %s", err.Error())
-			return fmt.Errorf("Error write to remote path: %v", err)
+			return sent, err
+		}
+		expected := hex.EncodeToString(h.Sum(nil))
+		if actual == expected {
+			return sent, nil
+		}
+		err = &VerifyError{File: to, Expected: expected, Actual: actual}
+		if attempt == verifyAttempts {
+			return sent, err
 		}
+		logOutput("%v. Sending it again\n", err)
 	}
-	return err
 }
 
-func DeleteSingle(destFs filesystem.FileSystem, destRaw string) error {
-	return destFs.Delete(destRaw)
+// Bring an existing File on the destination up to date, by sending
+// only the blocks that differ from the source
+func deltaCopyFile(fromFs filesystem.FileSystem, from filesystem.File, toFs filesystem.DeltaFileSystem, to filesystem.File, sig *delta.Signature, perm os.FileMode, h hash.Hash) (int64, error) {
+	r, err := openSource(fromFs, from, h)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	patch, err := toFs.Patch(to, perm, sig.BlockSize)
+	if err != nil {
+		return 0, err
+	}
+	w := &countingPatchWriter{PatchWriter: patch}
+	if err = delta.Delta(sig, r, w); err != nil {
+		w.Abort()
+		return w.n, err
+	}
+	return w.n, w.Close()
 }
 
-func CopySingle(srcFs filesystem.FileSystem, srcRaw string, destFs filesystem.FileSystem, destRaw string) error {
-	fromFile, _, err := utils.MakeFile(srcRaw)
-	toFile := utils.MkToFile(srcRaw, destRaw, fromFile)
+// Files at least this large are sent so that they can be resumed
+var resumeSize int64 = 1024 * 1024
 
+// Send a File, carrying on from what an interrupted transfer already wrote
+// to the destination, as far as it matches the source. The whole File is
+// checked against the hash of the source before it replaces the original.
+func resumeCopyFile(fromFs filesystem.FileSystem, from filesystem.File, toFs filesystem.ResumeFileSystem, to filesystem.File, perm os.FileMode, h hash.Hash) (int64, error) {
+	sig, err := toFs.PartialSignature(to, delta.BlockSize(from.Size()))
 	if err != nil {
-		logOutput("Error opening dest file: %v", err)
-		return fmt.Errorf("Error opening dest file: %v", err)
+		return 0, err
 	}
 
-	if fromFile.IsDir() {
-		logOutput("Mkdir %s -> %s\n", fromFile.Path(), toFile.Path())
-		destFs.MkDir(toFile)
-	} else {
-		logOutput("Copying file: %s -> %s\n", fromFile.Path(), toFile.Path())
-		bytes, err := srcFs.Read(fromFile)
-		err = destFs.Write(toFile, bytes, fromFile.Mode())
-		if err != nil {
-			logOutput("Error copying file %s: %v", fromFile.Path(), err)
-		}
+	algorithm := hashAlgorithm()
+	sum, err := filesystem.NewHash(algorithm)
+	if err != nil {
+		return 0, err
+	}
+	r, err := openSource(fromFs, from, h)
+	if err != nil {
+		return 0, err
 	}
+	defer r.Close()
+	src := io.TeeReader(r, sum)
 
-	return nil
+	offset, rest, err := delta.MatchPrefix(sig, src)
+	if err != nil {
+		return 0, err
+	}
+	if offset > 0 {
+		logOutput("Resuming %s -> %s from byte %d\n", from.Path(), to.Path(), offset)
+	}
+
+	w, err := toFs.Resume(to, perm, offset, algorithm)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, io.MultiReader(bytes.NewReader(rest), src))
+	if err != nil {
+		w.Abort()
+		return n, err
+	}
+	return n, w.Commit(hex.EncodeToString(sum.Sum(nil)))
+}
+
+// Counts the literal data sent in a delta
+type countingPatchWriter struct {
+	delta.PatchWriter
+	n int64
+}
+
+func (w *countingPatchWriter) WriteOp(op delta.Operation) error {
+	w.n += int64(len(op.Data))
+	return w.PatchWriter.WriteOp(op)
+}
+
+// Open a File for reading, optionally feeding everything read into h
+func openSource(fromFs filesystem.FileSystem, from filesystem.File, h hash.Hash) (io.ReadCloser, error) {
+	r, err := fromFs.Open(from)
+	if err != nil || h == nil {
+		return r, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(r, h), r}, nil
 }
 
 func ignoreFile(filepath string, excludes []regexp.Regexp) bool {
@@ -1 +1,228 @@
 package sync
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/mefellows/mirror/filesystem"
+	"github.com/mefellows/mirror/filesystem/fs"
+	utils "github.com/mefellows/mirror/filesystem/utils"
+	"github.com/mefellows/mirror/mirror"
+)
+
+// Create a source and destination directory for a sync test
+func makeSyncDirs(t *testing.T) (string, string) {
+	src, err := ioutil.TempDir("", "mirror-sync-src")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	dest, err := ioutil.TempDir("", "mirror-sync-dest")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	return src, dest
+}
+
+// A local FileSystem, reached through flaky:// URLs, whose listings fail
+// while listingFails is set, as a remote one's would when the connection drops
+type flakyFileSystem struct {
+	fs.StdFileSystem
+}
+
+var listingFails bool
+
+func (f flakyFileSystem) FileMap(root filesystem.File) (filesystem.FileMap, error) {
+	if listingFails {
+		return nil, errors.New("Listing failed")
+	}
+	return f.StdFileSystem.FileMap(root)
+}
+
+func init() {
+	mirror.FileSystemFactories.Register(func(string) (filesystem.FileSystem, error) {
+		return flakyFileSystem{}, nil
+	}, "flaky")
+}
+
+func writeTestFile(t *testing.T, path string, contents string) {
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("Unable to write test file: %v", err)
+	}
+}
+
+func TestSync(t *testing.T) {
+	src, dest := makeSyncDirs(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+
+	writeTestFile(t, filepath.Join(src, "foo.txt"), "foo")
+	writeTestFile(t, filepath.Join(src, "bar", "baz.txt"), "baz")
+
+	err := Sync(src, dest, &Options{})
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+
+	for path, contents := range map[string]string{"foo.txt": "foo", "bar/baz.txt": "baz"} {
+		data, err := ioutil.ReadFile(filepath.Join(dest, path))
+		if err != nil {
+			t.Fatalf("Expected %s to be synced: %v", path, err)
+		}
+		if string(data) != contents {
+			t.Fatalf("Expected %s to contain '%s', got '%s'", path, contents, data)
+		}
+	}
+}
+
+func TestSync_Delete(t *testing.T) {
+	src, dest := makeSyncDirs(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+
+	writeTestFile(t, filepath.Join(src, "foo.txt"), "foo")
+	writeTestFile(t, filepath.Join(dest, "foo.txt"), "foo")
+	writeTestFile(t, filepath.Join(dest, "stale.txt"), "stale")
+	writeTestFile(t, filepath.Join(dest, "old", "bar.txt"), "bar")
+	writeTestFile(t, filepath.Join(dest, "keep.log"), "excluded")
+
+	// A directory gone from src, but holding an excluded file
+	writeTestFile(t, filepath.Join(dest, "gone", "keep.log"), "excluded")
+	writeTestFile(t, filepath.Join(dest, "gone", "drop.txt"), "drop")
+	writeTestFile(t, filepath.Join(dest, "gone", "sub", "drop.txt"), "drop")
+
+	exclude := regexp.MustCompilePOSIX(`\.log$`)
+	err := Sync(src, dest, &Options{Delete: true, Exclude: []regexp.Regexp{*exclude}})
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+
+	for _, path := range []string{"stale.txt", "old", "old/bar.txt", "gone/drop.txt", "gone/sub"} {
+		if _, err := os.Stat(filepath.Join(dest, path)); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s to be deleted from dest", path)
+		}
+	}
+	for _, path := range []string{"foo.txt", "keep.log", "gone/keep.log"} {
+		if _, err := os.Stat(filepath.Join(dest, path)); err != nil {
+			t.Fatalf("Expected %s to be kept in dest", path)
+		}
+	}
+}
+
+func TestSync_NoDelete(t *testing.T) {
+	src, dest := makeSyncDirs(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+
+	writeTestFile(t, filepath.Join(dest, "stale.txt"), "stale")
+	if err := Sync(src, dest, &Options{}); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "stale.txt")); err != nil {
+		t.Fatalf("Expected stale.txt to be kept without --delete")
+	}
+}
+
+func TestSync_Resume(t *testing.T) {
+	src, dest := makeSyncDirs(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+
+	data := make([]byte, 2*resumeSize)
+	rand.Read(data)
+	ioutil.WriteFile(filepath.Join(src, "big.bin"), data, 0644)
+
+	// Left by an interrupted transfer, with a torn final block
+	partial := append(data[:resumeSize:resumeSize], "torn"...)
+	ioutil.WriteFile(filepath.Join(dest, ".big.bin.mirror-partial"), partial, 0600)
+
+	plan, err := NewPlan(src, dest, &Options{})
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	result, err := plan.Execute()
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if result.Bytes > resumeSize {
+		t.Fatalf("Expected at most %d bytes to be sent, sent %d", resumeSize, result.Bytes)
+	}
+	onDisk, _ := ioutil.ReadFile(filepath.Join(dest, "big.bin"))
+	if !bytes.Equal(onDisk, data) {
+		t.Fatalf("Expected resumed file to match the source")
+	}
+	if _, err := os.Stat(filepath.Join(dest, ".big.bin.mirror-partial")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the partial file to be moved into place")
+	}
+}
+
+// Corrupts the first byte of the next few Files it writes
+type corruptingFileSystem struct {
+	fs.StdFileSystem
+	corrupt *int
+}
+
+func (c corruptingFileSystem) Create(file filesystem.File, perm os.FileMode) (io.WriteCloser, error) {
+	w, err := c.StdFileSystem.Create(file, perm)
+	if err != nil || *c.corrupt == 0 {
+		return w, err
+	}
+	*c.corrupt--
+	return corruptingWriter{w}, nil
+}
+
+type corruptingWriter struct {
+	io.WriteCloser
+}
+
+func (w corruptingWriter) Write(p []byte) (int, error) {
+	return w.WriteCloser.Write(append([]byte{p[0] + 1}, p[1:]...))
+}
+
+func TestVerifiedCopyFile(t *testing.T) {
+	src, dest := makeSyncDirs(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	options = &Options{Verify: true}
+
+	writeTestFile(t, filepath.Join(src, "foo.txt"), "foo")
+	from, _, _ := utils.MakeFile(filepath.Join(src, "foo.txt"))
+	to := utils.MkToFile(src, dest, from)
+
+	corrupt := 1
+	toFs := corruptingFileSystem{corrupt: &corrupt}
+	n, err := verifiedCopyFile(fs.StdFileSystem{}, from, toFs, to, 0644)
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if n != 6 {
+		t.Fatalf("Expected the file to be sent twice, sent %d bytes", n)
+	}
+
+	corrupt = verifyAttempts
+	if _, err = verifiedCopyFile(fs.StdFileSystem{}, from, toFs, to, 0644); err == nil {
+		t.Fatalf("Expected verification to fail")
+	} else if _, ok := err.(*VerifyError); !ok {
+		t.Fatalf("Expected a *VerifyError, got %v", err)
+	}
+}
+
+func TestSync_ChecksumWithCompare(t *testing.T) {
+	src, dest := makeSyncDirs(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+
+	if err := Sync(src, dest, &Options{Checksum: true, Compare: []string{"size"}}); err == nil {
+		t.Fatalf("Expected Checksum with Compare to be rejected")
+	}
+	if err := Sync(src, dest, &Options{Compare: []string{"size", "hash"}}); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+}
@@ -0,0 +1,425 @@
+package sync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mefellows/mirror/filesystem"
+	utils "github.com/mefellows/mirror/filesystem/utils"
+	"github.com/mefellows/mirror/mirror"
+)
+
+// A path that was changed on both sides since the last sync
+type Conflict struct {
+	Path string          // Path relative to the src and dest roots
+	Src  filesystem.File // The current src File, if it still exists
+	Dest filesystem.File // The current dest File, if it still exists
+}
+
+type change int
+
+const (
+	unchanged change = iota
+	created
+	modified
+	deleted
+)
+
+// One side of a two-way sync
+type side struct {
+	fs    filesystem.FileSystem
+	root  string
+	host  string
+	files filesystem.FileMap
+}
+
+func newSide(raw string) (*side, filesystem.File, error) {
+	root, fs, err := utils.MakeFile(raw)
+	if err != nil {
+		return nil, root, err
+	}
+	host := utils.ExtractURL(raw).Host
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	return &side{fs: fs, root: root.Path(), host: host}, root, nil
+}
+
+func (s *side) path(relative string) string {
+	return utils.LinuxPath(s.root + relative)
+}
+
+// In-progress state of a two-way sync
+type twoWaySync struct {
+	left      *side
+	right     *side
+	state     *State
+	deletions []deletion
+	removed   []string // Directories being removed; anything below them is skipped
+}
+
+type deletion struct {
+	path string
+	side *side
+}
+
+// Synchronise src and dest in both directions.
+//
+// Each side is compared against the State recorded at the end of the last
+// run to find out what changed, and where. Changes made on one side only
+// are propagated to the other. Paths changed on both sides are passed to
+// the ConflictResolver in the Options; any it leaves unresolved are
+// returned as Conflicts and left untouched.
+func SyncTwoWay(srcRaw string, destRaw string, opts *Options) ([]Conflict, error) {
+	options = opts
+
+	left, srcRoot, err := newSide(srcRaw)
+	if err != nil {
+		return nil, err
+	}
+	right, destRoot, err := newSide(destRaw)
+	if err != nil {
+		return nil, err
+	}
+	if !srcRoot.IsDir() || !destRoot.IsDir() {
+		return nil, errors.New("Two-way sync requires both src and dest to be directories")
+	}
+
+	state, err := LoadState(srcRaw, destRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	// A side that could not be listed would otherwise look like everything
+	// on it had been deleted, so nothing is touched, and the State is kept
+	var leftErr, rightErr error
+	var done sync.WaitGroup
+	done.Add(2)
+	go func() {
+		left.files, leftErr = left.fs.FileMap(srcRoot)
+		done.Done()
+	}()
+	go func() {
+		right.files, rightErr = right.fs.FileMap(destRoot)
+		done.Done()
+	}()
+	done.Wait()
+	if leftErr != nil {
+		return nil, fmt.Errorf("Unable to list src %s: %v", srcRaw, leftErr)
+	}
+	if rightErr != nil {
+		return nil, fmt.Errorf("Unable to list dest %s: %v", destRaw, rightErr)
+	}
+
+	// A resolver that fails stops the sync before anything is deleted, and
+	// without recording what it had done so far
+	t := &twoWaySync{left: left, right: right, state: state}
+	conflicts, err := t.run()
+	if err != nil {
+		return conflicts, err
+	}
+	t.finish()
+	return conflicts, state.Save()
+}
+
+func (t *twoWaySync) run() ([]Conflict, error) {
+	paths := unionPaths(t.left.files, t.right.files, t.state.Files)
+
+	// Work out what has happened on each side since the last sync
+	srcChanges := make(map[string]change)
+	destChanges := make(map[string]change)
+	for _, path := range paths {
+		prev, known := t.state.Files[path]
+		srcChanges[path] = detectChange(t.left, path, prev.Src, known)
+		destChanges[path] = detectChange(t.right, path, prev.Dest, known)
+	}
+
+	conflicts := make([]Conflict, 0)
+	for _, path := range paths {
+		if ignoreFile(t.left.path(path), options.Exclude) || t.isRemoved(path) {
+			continue
+		}
+		srcChange, destChange := srcChanges[path], destChanges[path]
+		srcFile, inSrc := t.left.files[path]
+		destFile, inDest := t.right.files[path]
+
+		var err error
+		conflict := false
+		switch {
+		case srcChange == unchanged && destChange == unchanged:
+			if inSrc && inDest {
+				t.state.Files[path] = PathState{
+					Src:  newFileState(srcFile, t.state.Files[path].Src.Hash),
+					Dest: newFileState(destFile, t.state.Files[path].Dest.Hash),
+				}
+			}
+
+		case destChange == unchanged:
+			if conflict = srcChange == deleted && hasChangesBelow(path, destChanges); !conflict {
+				err = t.update(t.left, t.right, path)
+			}
+
+		case srcChange == unchanged:
+			if conflict = destChange == deleted && hasChangesBelow(path, srcChanges); !conflict {
+				err = t.update(t.right, t.left, path)
+			}
+
+		default:
+			// Changed on both sides; only safe if they ended up the same
+			if !inSrc && !inDest {
+				delete(t.state.Files, path)
+				continue
+			}
+			conflict = !(inSrc && inDest && t.sameContent(path))
+		}
+
+		if err != nil {
+			logOutput("Error syncing %s: %v", path, err)
+		}
+		if conflict {
+			c := Conflict{Path: path, Src: srcFile, Dest: destFile}
+			resolved, err := t.resolve(c)
+			if err != nil {
+				return conflicts, err
+			}
+			if !resolved {
+				conflicts = append(conflicts, c)
+			}
+		}
+	}
+	return conflicts, nil
+}
+
+// Apply the configured ConflictResolver, returning false if the
+// conflict is to be left in place
+func (t *twoWaySync) resolve(c Conflict) (bool, error) {
+	if options.Resolver == nil {
+		return false, nil
+	}
+	resolution, err := options.Resolver(c.Path, c.Src, c.Dest)
+	if err != nil {
+		return false, err
+	}
+
+	switch resolution {
+	case mirror.UseSrc:
+		err = t.update(t.left, t.right, c.Path)
+	case mirror.UseDest:
+		err = t.update(t.right, t.left, c.Path)
+	case mirror.KeepBoth:
+		err = t.keepBoth(c)
+	default:
+		return false, nil
+	}
+	if err != nil {
+		logOutput("Error resolving conflict for %s: %v", c.Path, err)
+		return false, nil
+	}
+	logOutput("Resolved conflict for %s\n", c.Path)
+	return true, nil
+}
+
+// Resolve a conflict by keeping both versions. The losing version is
+// renamed to <path>.conflict-<host>-<timestamp> on both sides.
+func (t *twoWaySync) keepBoth(c Conflict) error {
+	_, inSrc := t.left.files[c.Path]
+	_, inDest := t.right.files[c.Path]
+	switch {
+	case !inDest:
+		return t.update(t.left, t.right, c.Path)
+	case !inSrc:
+		return t.update(t.right, t.left, c.Path)
+	}
+
+	// A directory always keeps its name, otherwise the newest File does
+	winner, loser := t.left, t.right
+	if c.Dest.IsDir() || (c.Src.IsDir() == c.Dest.IsDir() && c.Dest.ModTime().After(c.Src.ModTime())) {
+		winner, loser = t.right, t.left
+	}
+
+	file := loser.files[c.Path]
+	renamed := fmt.Sprintf("%s.conflict-%s-%s", c.Path, loser.host, file.ModTime().Format("20060102-150405"))
+	moved := file
+	moved.FileName = filepath.Base(renamed)
+	moved.FilePath = loser.path(renamed)
+	logOutput("Keeping both versions of %s: %s -> %s\n", c.Path, file.Path(), moved.Path())
+	if _, err := copyFile(loser.fs, file, loser.fs, moved, file.Mode(), nil); err != nil {
+		return err
+	}
+	written, err := loser.fs.ReadFile(moved.Path())
+	if err != nil {
+		return err
+	}
+	loser.files[renamed] = written
+
+	if err = t.update(loser, winner, renamed); err != nil {
+		return err
+	}
+	return t.update(winner, loser, c.Path)
+}
+
+// Make a path on one side match the other, recording the result in the State
+func (t *twoWaySync) update(from *side, to *side, path string) error {
+	file, exists := from.files[path]
+	existing, inTo := to.files[path]
+
+	if !exists {
+		if inTo {
+			t.deletions = append(t.deletions, deletion{path: path, side: to})
+			if existing.IsDir() {
+				t.removed = append(t.removed, path)
+			}
+		}
+		return nil
+	}
+
+	// A File can't be replaced by a directory, or vice-versa
+	if inTo && existing.IsDir() != file.IsDir() {
+		if err := DeleteSingle(to.fs, existing.Path()); err != nil {
+			return err
+		}
+	}
+
+	toFile := utils.MkToFile(from.root, to.root, file)
+	var hash string
+	if file.IsDir() {
+		logOutput("Mkdir: %s -> %s\n", file.Path(), toFile.Path())
+		if err := to.fs.MkDir(toFile); err != nil {
+			return err
+		}
+	} else {
+		logOutput("Copying file: %s -> %s\n", file.Path(), toFile.Path())
+		h := sha256.New()
+		if _, err := copyFile(from.fs, file, to.fs, toFile, file.Mode(), h); err != nil {
+			return err
+		}
+		hash = hex.EncodeToString(h.Sum(nil))
+	}
+
+	written, err := to.fs.ReadFile(toFile.Path())
+	if err != nil {
+		return err
+	}
+	if from == t.left {
+		t.state.Files[path] = PathState{Src: newFileState(file, hash), Dest: newFileState(written, hash)}
+	} else {
+		t.state.Files[path] = PathState{Src: newFileState(written, hash), Dest: newFileState(file, hash)}
+	}
+	return nil
+}
+
+// Check whether Files changed on both sides have converged on the same
+// contents, recording them as synchronised if so
+func (t *twoWaySync) sameContent(path string) bool {
+	srcFile, destFile := t.left.files[path], t.right.files[path]
+	if srcFile.IsDir() || destFile.IsDir() {
+		if srcFile.IsDir() && destFile.IsDir() {
+			t.state.Files[path] = PathState{Src: newFileState(srcFile, ""), Dest: newFileState(destFile, "")}
+			return true
+		}
+		return false
+	}
+	if srcFile.Size() != destFile.Size() {
+		return false
+	}
+	srcHash, err := filesystem.FileHash(t.left.fs, srcFile, filesystem.SHA256)
+	if err != nil {
+		return false
+	}
+	destHash, err := filesystem.FileHash(t.right.fs, destFile, filesystem.SHA256)
+	if err != nil || srcHash != destHash {
+		return false
+	}
+	t.state.Files[path] = PathState{Src: newFileState(srcFile, srcHash), Dest: newFileState(destFile, destHash)}
+	return true
+}
+
+func (t *twoWaySync) isRemoved(path string) bool {
+	for _, dir := range t.removed {
+		if strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Carry out pending deletions, removing the contents of directories
+// before the directories themselves
+func (t *twoWaySync) finish() {
+	for i := len(t.deletions) - 1; i >= 0; i-- {
+		d := t.deletions[i]
+		logOutput("Deleting: %s\n", d.side.path(d.path))
+		if err := DeleteSingle(d.side.fs, d.side.path(d.path)); err != nil {
+			logOutput("Error deleting file %s: %v", d.side.path(d.path), err)
+			continue
+		}
+		for path := range t.state.Files {
+			if path == d.path || strings.HasPrefix(path, d.path+"/") {
+				delete(t.state.Files, path)
+			}
+		}
+	}
+}
+
+// Determine how a path on one side has changed since it was last synchronised
+func detectChange(s *side, path string, prev FileState, known bool) change {
+	file, exists := s.files[path]
+	switch {
+	case !exists && !known:
+		return unchanged
+	case !exists:
+		return deleted
+	case !known:
+		return created
+	case file.IsDir() || prev.IsDir:
+		if file.IsDir() == prev.IsDir {
+			return unchanged
+		}
+		return modified
+	case file.Size() == prev.Size && file.ModTime().Equal(prev.ModTime):
+		return unchanged
+	case file.Size() == prev.Size && prev.Hash != "":
+		// Touched, but possibly not modified
+		if hash, err := filesystem.FileHash(s.fs, file, filesystem.SHA256); err == nil && hash == prev.Hash {
+			return unchanged
+		}
+	}
+	return modified
+}
+
+// Check whether anything inside a directory has changed
+func hasChangesBelow(dir string, changes map[string]change) bool {
+	for path, c := range changes {
+		if c != unchanged && strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// All known paths, sorted so that directories precede their contents
+func unionPaths(src filesystem.FileMap, dest filesystem.FileMap, state map[string]PathState) []string {
+	seen := make(map[string]bool)
+	for path := range src {
+		seen[path] = true
+	}
+	for path := range dest {
+		seen[path] = true
+	}
+	for path := range state {
+		seen[path] = true
+	}
+	paths := make([]string, 0, len(seen))
+	for path := range seen {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,218 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mefellows/mirror/mirror"
+)
+
+func readTestFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected %s to exist: %v", path, err)
+	}
+	return string(data)
+}
+
+func TestSyncTwoWay(t *testing.T) {
+	src, dest := makeSyncDirs(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	home, _ := ioutil.TempDir("", "mirror-home")
+	defer os.RemoveAll(home)
+	os.Setenv("MIRROR_HOME", home)
+	defer os.Setenv("MIRROR_HOME", "")
+
+	writeTestFile(t, filepath.Join(src, "a.txt"), "a")
+	writeTestFile(t, filepath.Join(src, "both.txt"), "both")
+	writeTestFile(t, filepath.Join(dest, "b", "b.txt"), "b")
+
+	conflicts, err := SyncTwoWay(src, dest, &Options{})
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if len(conflicts) != 0 {
+		t.Fatalf("Expected no conflicts on first sync, got %v", conflicts)
+	}
+	if readTestFile(t, filepath.Join(dest, "a.txt")) != "a" {
+		t.Fatalf("Expected a.txt to be copied to dest")
+	}
+	if readTestFile(t, filepath.Join(src, "b", "b.txt")) != "b" {
+		t.Fatalf("Expected b/b.txt to be copied to src")
+	}
+	if _, err := os.Stat(StateFile(src, dest)); err != nil {
+		t.Fatalf("Expected sync state to be saved: %v", err)
+	}
+
+	// Change each side independently, and the same file on both sides
+	writeTestFile(t, filepath.Join(dest, "a.txt"), "a, modified on dest")
+	os.RemoveAll(filepath.Join(src, "b"))
+	writeTestFile(t, filepath.Join(src, "both.txt"), "changed on src")
+	writeTestFile(t, filepath.Join(dest, "both.txt"), "changed on dest")
+
+	conflicts, err = SyncTwoWay(src, dest, &Options{})
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if readTestFile(t, filepath.Join(src, "a.txt")) != "a, modified on dest" {
+		t.Fatalf("Expected change to a.txt to be copied back to src")
+	}
+	if _, err := os.Stat(filepath.Join(dest, "b")); !os.IsNotExist(err) {
+		t.Fatalf("Expected deletion of b/ to be propagated to dest")
+	}
+	if len(conflicts) != 1 || conflicts[0].Path != "/both.txt" {
+		t.Fatalf("Expected a single conflict for /both.txt, got %v", conflicts)
+	}
+	if readTestFile(t, filepath.Join(src, "both.txt")) != "changed on src" || readTestFile(t, filepath.Join(dest, "both.txt")) != "changed on dest" {
+		t.Fatalf("Expected conflicting files to be left untouched")
+	}
+
+	// Conflicts remain until resolved
+	conflicts, _ = SyncTwoWay(src, dest, &Options{})
+	if len(conflicts) != 1 {
+		t.Fatalf("Expected conflict to be reported again, got %v", conflicts)
+	}
+}
+
+// Set up a src and dest that have been synchronised once, then
+// modify the same file on both sides
+func makeConflict(t *testing.T) (string, string, func()) {
+	src, dest := makeSyncDirs(t)
+	home, _ := ioutil.TempDir("", "mirror-home")
+	os.Setenv("MIRROR_HOME", home)
+	cleanup := func() {
+		os.RemoveAll(src)
+		os.RemoveAll(dest)
+		os.RemoveAll(home)
+		os.Setenv("MIRROR_HOME", "")
+	}
+
+	writeTestFile(t, filepath.Join(src, "both.txt"), "both")
+	if _, err := SyncTwoWay(src, dest, &Options{}); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	writeTestFile(t, filepath.Join(src, "both.txt"), "changed on src")
+	writeTestFile(t, filepath.Join(dest, "both.txt"), "changed on dest, later")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(dest, "both.txt"), later, later)
+	return src, dest, cleanup
+}
+
+func TestSyncTwoWay_Resolvers(t *testing.T) {
+	cases := map[string]string{
+		"newest-wins": "changed on dest, later",
+		"source-wins": "changed on src",
+		"dest-wins":   "changed on dest, later",
+	}
+	for name, expected := range cases {
+		src, dest, cleanup := makeConflict(t)
+		resolver, ok := mirror.ConflictResolvers.Lookup(name)
+		if !ok {
+			t.Fatalf("Expected resolver %s to be registered", name)
+		}
+		conflicts, err := SyncTwoWay(src, dest, &Options{Resolver: resolver})
+		if err != nil {
+			t.Fatalf("%s: did not expect err: %v", name, err)
+		}
+		if len(conflicts) != 0 {
+			t.Fatalf("%s: expected conflict to be resolved, got %v", name, conflicts)
+		}
+		for _, dir := range []string{src, dest} {
+			if contents := readTestFile(t, filepath.Join(dir, "both.txt")); contents != expected {
+				t.Fatalf("%s: expected '%s' in %s, got '%s'", name, expected, dir, contents)
+			}
+		}
+		cleanup()
+	}
+}
+
+func TestSyncTwoWay_KeepBoth(t *testing.T) {
+	src, dest, cleanup := makeConflict(t)
+	defer cleanup()
+
+	conflicts, err := SyncTwoWay(src, dest, &Options{Resolver: KeepBoth})
+	if err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	if len(conflicts) != 0 {
+		t.Fatalf("Expected conflict to be resolved, got %v", conflicts)
+	}
+	for _, dir := range []string{src, dest} {
+		if contents := readTestFile(t, filepath.Join(dir, "both.txt")); contents != "changed on dest, later" {
+			t.Fatalf("Expected newest version to keep the name in %s, got '%s'", dir, contents)
+		}
+		matches, _ := filepath.Glob(filepath.Join(dir, "both.txt.conflict-*"))
+		if len(matches) != 1 {
+			t.Fatalf("Expected a single renamed conflict file in %s, got %v", dir, matches)
+		}
+		if contents := readTestFile(t, matches[0]); contents != "changed on src" {
+			t.Fatalf("Expected renamed file to hold the older version, got '%s'", contents)
+		}
+	}
+
+	// Both sides are now in sync
+	conflicts, _ = SyncTwoWay(src, dest, &Options{})
+	if len(conflicts) != 0 {
+		t.Fatalf("Expected no further conflicts, got %v", conflicts)
+	}
+}
+
+func TestSyncTwoWay_ListingFails(t *testing.T) {
+	src, dest := makeSyncDirs(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	home, _ := ioutil.TempDir("", "mirror-home")
+	defer os.RemoveAll(home)
+	os.Setenv("MIRROR_HOME", home)
+	defer os.Setenv("MIRROR_HOME", "")
+
+	writeTestFile(t, filepath.Join(src, "a.txt"), "a")
+	writeTestFile(t, filepath.Join(dest, "b.txt"), "b")
+	if _, err := SyncTwoWay(src, "flaky://"+dest, &Options{}); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	state, _ := ioutil.ReadFile(StateFile(src, "flaky://"+dest))
+
+	// Were the failed listing taken as empty, every file would be deleted from src
+	listingFails = true
+	defer func() { listingFails = false }()
+	if _, err := SyncTwoWay(src, "flaky://"+dest, &Options{}); err == nil {
+		t.Fatalf("Expected a failed listing to fail the sync")
+	}
+	for _, path := range []string{"a.txt", "b.txt"} {
+		if _, err := os.Stat(filepath.Join(src, path)); err != nil {
+			t.Fatalf("Expected %s to be untouched in src: %v", path, err)
+		}
+	}
+	if after, _ := ioutil.ReadFile(StateFile(src, "flaky://"+dest)); string(after) != string(state) {
+		t.Fatalf("Expected the sync state to be untouched")
+	}
+}
+
+func TestSyncTwoWay_Fail(t *testing.T) {
+	src, dest, cleanup := makeConflict(t)
+	defer cleanup()
+
+	// A deletion found before the conflict must not be carried out either
+	writeTestFile(t, filepath.Join(src, "a.txt"), "a")
+	if _, err := SyncTwoWay(src, dest, &Options{}); err != nil {
+		t.Fatalf("Did not expect err: %v", err)
+	}
+	os.Remove(filepath.Join(src, "a.txt"))
+	state, _ := ioutil.ReadFile(StateFile(src, dest))
+
+	_, err := SyncTwoWay(src, dest, &Options{Resolver: FailOnConflict})
+	if err == nil {
+		t.Fatalf("Expected err")
+	}
+	if _, err := os.Stat(filepath.Join(dest, "a.txt")); err != nil {
+		t.Fatalf("Expected a.txt not to be deleted from dest: %v", err)
+	}
+	if after, _ := ioutil.ReadFile(StateFile(src, dest)); string(after) != string(state) {
+		t.Fatalf("Expected the sync state not to be saved")
+	}
+}
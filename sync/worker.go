@@ -0,0 +1,66 @@
+package sync
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// The errors from every Operation that failed while executing a Plan
+type ExecuteError struct {
+	Errors []error
+}
+
+func (e *ExecuteError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d operation(s) failed: %s", len(e.Errors), strings.Join(messages, "; "))
+}
+
+// Collects the errors of Operations executed concurrently
+type errorCollector struct {
+	sync.Mutex
+	errors []error
+}
+
+func (c *errorCollector) add(op Operation, err error) {
+	c.Lock()
+	defer c.Unlock()
+	c.errors = append(c.errors, fmt.Errorf("Error during %s of %s: %v", op.Type, op.Dest.Path(), err))
+}
+
+// nil if nothing failed, otherwise an *ExecuteError
+func (c *errorCollector) err() error {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.errors) == 0 {
+		return nil
+	}
+	return &ExecuteError{Errors: c.errors}
+}
+
+// Call work for each of the given items on a pool of workers,
+// returning once every item is done
+func runWorkers(workers int, items []int, work func(int)) {
+	if workers < 1 {
+		workers = 1
+	}
+	queue := make(chan int)
+	var done sync.WaitGroup
+	done.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			for item := range queue {
+				work(item)
+			}
+			done.Done()
+		}()
+	}
+	for _, item := range items {
+		queue <- item
+	}
+	close(queue)
+	done.Wait()
+}
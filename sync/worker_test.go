@@ -0,0 +1,39 @@
+package sync
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/mefellows/mirror/filesystem"
+)
+
+func TestRunWorkers(t *testing.T) {
+	items := make([]int, 100)
+	for i := range items {
+		items[i] = i
+	}
+
+	var lock sync.Mutex
+	seen := make(map[int]bool)
+	runWorkers(4, items, func(item int) {
+		lock.Lock()
+		seen[item] = true
+		lock.Unlock()
+	})
+	if len(seen) != len(items) {
+		t.Fatalf("Expected %d items to be processed, got %d", len(items), len(seen))
+	}
+}
+
+func TestErrorCollector(t *testing.T) {
+	errs := &errorCollector{}
+	if errs.err() != nil {
+		t.Fatalf("Expected no error")
+	}
+	errs.add(Operation{Type: OpCopy, Dest: filesystem.File{FilePath: "/dest/foo"}}, errors.New("disk full"))
+	err := errs.err()
+	if err == nil || err.Error() != "1 operation(s) failed: Error during copy of /dest/foo: disk full" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}